@@ -0,0 +1,124 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"udr-tree/crdt"
+)
+
+// API HTTP con JSON para operar una replica sin la consola:
+//
+//	POST /add    {"name": ..., "parent": ...}
+//	POST /mv     {"node": ..., "parent": ...}
+//	POST /rm     {"node": ...}
+//	GET  /tree   ?node=root&ids=1&trash=1, subarbol con el formato de export
+//	GET  /stats  estadisticas de la replica
+//	GET  /events eventos de las operaciones aplicadas, ver events
+//	GET  /       visor del arbol que se actualiza con /events
+//
+// Las operaciones responden {"time": ...} y los errores {"error": ...}
+type Server struct {
+	tree *crdt.Tree
+	mux  *http.ServeMux
+	// las operaciones van de a una, asi el tiempo es el de cada operacion
+	ops sync.Mutex
+}
+
+type request struct {
+	Name   string `json:"name"`
+	Node   string `json:"node"`
+	Parent string `json:"parent"`
+}
+
+// tiempo de Lamport de la operacion aplicada
+type operationResponse struct {
+	Time uint64 `json:"time"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+func New(tree *crdt.Tree) *Server {
+	server := &Server{tree: tree, mux: http.NewServeMux()}
+	server.mux.HandleFunc("POST /add", server.operation(func(req request) error {
+		return tree.Add(req.Name, req.Parent)
+	}))
+	server.mux.HandleFunc("POST /mv", server.operation(func(req request) error {
+		return tree.Move(req.Node, req.Parent)
+	}))
+	server.mux.HandleFunc("POST /rm", server.operation(func(req request) error {
+		return tree.Remove(req.Node)
+	}))
+	server.mux.HandleFunc("GET /tree", server.subtree)
+	server.mux.HandleFunc("GET /stats", server.stats)
+	server.mux.HandleFunc("GET /events", server.events)
+	server.mux.HandleFunc("GET /{$}", server.viewer)
+	return server
+}
+
+func (server *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	server.mux.ServeHTTP(w, r)
+}
+
+func (server *Server) ListenAndServe(addr string) error {
+	return http.ListenAndServe(addr, server)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// las operaciones rechazadas por el arbol responden 409
+func (server *Server) operation(op func(request) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req request
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, errorResponse{"invalid request: " + err.Error()})
+			return
+		}
+
+		server.ops.Lock()
+		err := op(req)
+		time := server.tree.LastLocalTime()
+		server.ops.Unlock()
+		if err != nil {
+			writeJSON(w, http.StatusConflict, errorResponse{err.Error()})
+			return
+		}
+
+		writeJSON(w, http.StatusOK, operationResponse{time})
+	}
+}
+
+func (server *Server) subtree(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	node := query.Get("node")
+	opts := crdt.ExportOptions{IDs: query.Get("ids") != ""}
+	var err error
+	w.Header().Set("Content-Type", "application/json")
+	if node == "" || node == "root" {
+		opts.Trash = query.Get("trash") != ""
+		err = server.tree.Export(w, crdt.FormatJSON, opts)
+	} else {
+		err = server.tree.ExportSubtree(w, node, crdt.FormatJSON, opts)
+	}
+
+	// el arbol no escribe nada si falla
+	if err != nil {
+		writeJSON(w, http.StatusNotFound, errorResponse{err.Error()})
+	}
+}
+
+func (server *Server) stats(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, server.tree.Stats())
+}
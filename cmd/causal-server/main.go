@@ -0,0 +1,48 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"log"
+	"strings"
+	"udr-tree/network"
+	"udr-tree/server"
+)
+
+func main() {
+	config := server.DefaultConfig
+	flag.IntVar(&config.MaxReplicas, "max-replicas", config.MaxReplicas, "number of replica ids")
+	flag.IntVar(&config.BacklogSize, "backlog", config.BacklogSize, "messages kept for each replica until it acknowledges them")
+	flag.StringVar(&config.BacklogDir, "backlog-dir", "", "keep the backlogs on disk in this directory")
+	flag.IntVar(&config.SnapshotEvery, "snapshot-every", config.SnapshotEvery, "operations of a document before asking a replica for its state, 0 disables it")
+	flag.Int64Var(&config.SegmentBytes, "segment-size", config.SegmentBytes, "size of each backlog segment on disk")
+	ws := flag.String("ws", "", "also accept WebSocket replicas at this address on path "+network.WebSocketPath)
+	origins := flag.String("ws-origins", "", "comma separated origins of the web pages allowed to connect over WebSocket, * allows any")
+	flag.Parse()
+	if flag.NArg() != 1 {
+		log.Fatal(errors.New("USE: ./causal-server [flags] [PORT]"))
+	}
+
+	if *origins != "" {
+		config.AllowedOrigins = strings.Split(*origins, ",")
+	}
+
+	srv, err := server.New(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *ws != "" {
+		go func() {
+			log.Fatal(srv.ListenAndServeWebSocket(*ws))
+		}()
+	}
+
+	log.Fatal(srv.ListenAndServe(":" + flag.Arg(0)))
+}
@@ -0,0 +1,74 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package crdt
+
+import (
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Una replica puede modificar un nodo si es duena del ancestro mas
+// cercano que tiene duenos. Sin duenos en el camino todas pueden.
+// Como los duenos se guardan en el historial, el chequeo da lo mismo
+// en todas las replicas al reaplicar las operaciones en orden
+func (tree *Tree) allowed(replica uint64, id uuid.UUID) bool {
+	for node := tree.nodes[id]; node != nil; node = node.parent {
+		if node.owners != nil {
+			for _, owner := range node.owners {
+				if owner == replica {
+					return true
+				}
+			}
+
+			return false
+		}
+	}
+
+	return true
+}
+
+// Cambia los duenos del subarbol de node, sin duenos el nodo hereda
+// los de su padre
+func (tree *Tree) SetOwners(node string, owners []uint64) error {
+	tree.Lock()
+	defer tree.Unlock()
+
+	nodeID, ok := tree.names[node]
+	if !ok {
+		return errors.New("owners: node does not exist")
+	} else if !tree.allowed(tree.id, nodeID) {
+		return errors.New("owners: permission denied")
+	} else if len(owners) == 0 {
+		owners = nil
+	}
+
+	op := Operation{
+		ReplicaID: tree.id,
+		Timestamp: tree.localTime,
+		NewParent: nilID,
+		Node:      nodeID,
+		Kind:      KindOwners,
+		Owners:    owners,
+		time:      time.Now(),
+	}
+	tree.apply(op)
+	return nil
+}
+
+func (tree *Tree) Owners(node string) ([]uint64, error) {
+	tree.RLock()
+	defer tree.RUnlock()
+
+	nodeID, ok := tree.names[node]
+	if !ok {
+		return nil, errors.New("owners: node does not exist")
+	}
+
+	return tree.nodes[nodeID].owners, nil
+}
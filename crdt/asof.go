@@ -0,0 +1,115 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package crdt
+
+import (
+	"errors"
+)
+
+// Estado del arbol guardado al truncar el historial. El historial del
+// arbol son las operaciones truncadas, con timestamp mayor a from, para
+// poder revertir el estado a cualquier tiempo entre from y timestamp
+type checkpoint struct {
+	from      uint64
+	timestamp uint64
+	tree      *Tree
+}
+
+// Vista de solo lectura del arbol en un tiempo de Lamport
+type View struct {
+	Timestamp uint64
+	tree      *Tree
+}
+
+func (view *View) Print() {
+	view.tree.Print()
+}
+
+func (view *View) GetNames() []string {
+	return view.tree.GetNames()
+}
+
+func (view *View) Debug() {
+	view.tree.Debug()
+}
+
+func (view *View) Value(name string) ([]byte, error) {
+	return view.tree.Value(name)
+}
+
+// Guarda hasta n checkpoints cuando se trunca el historial, para que
+// AsOf pueda reconstruir tiempos anteriores al historial actual
+func (tree *Tree) EnableCheckpoints(n int) {
+	tree.Lock()
+	defer tree.Unlock()
+
+	tree.maxCheckpoints = n
+	if len(tree.checkpoints) > n {
+		tree.checkpoints = tree.checkpoints[len(tree.checkpoints)-n:]
+	}
+}
+
+// Tiempo de Lamport de la ultima operacion que conoce la replica, igual
+// que Snapshot y Stats. AsOf(Time()) es el estado actual
+func (tree *Tree) Time() uint64 {
+	tree.RLock()
+	defer tree.RUnlock()
+
+	return tree.localTime - 1
+}
+
+// Tiempo de Lamport de la ultima operacion de esta replica
+func (tree *Tree) LastLocalTime() uint64 {
+	tree.RLock()
+	defer tree.RUnlock()
+
+	return tree.time[tree.id]
+}
+
+// revierte en una copia las operaciones con timestamp mayor a time
+func (tree *Tree) revertedCopy(time uint64) *Tree {
+	dup := tree.clone()
+	i := len(dup.history) - 1
+	for i >= 0 && dup.history[i].Timestamp > time {
+		dup.revert(&dup.history[i])
+		i--
+	}
+
+	dup.history = dup.history[:i+1]
+	return dup
+}
+
+// se llama con el lock tomado, el historial ya fue truncado hasta time y
+// truncated son las operaciones que se quitaron
+func (tree *Tree) saveCheckpoint(from, time uint64, truncated []LogOperation) {
+	dup := tree.revertedCopy(time)
+	dup.history = append([]LogOperation(nil), truncated...)
+	tree.checkpoints = append(tree.checkpoints, checkpoint{from, time, dup})
+	if len(tree.checkpoints) > tree.maxCheckpoints {
+		tree.checkpoints = tree.checkpoints[1:]
+	}
+}
+
+// Reconstruye el arbol como era en el tiempo de Lamport timestamp
+// revirtiendo el historial. Si el historial ya fue truncado se revierte
+// el primer checkpoint posterior a timestamp
+func (tree *Tree) AsOf(timestamp uint64) (*View, error) {
+	tree.RLock()
+	defer tree.RUnlock()
+
+	if timestamp >= tree.truncatedAt {
+		return &View{timestamp, tree.revertedCopy(timestamp)}, nil
+	}
+
+	for _, cp := range tree.checkpoints {
+		if cp.timestamp >= timestamp && cp.from <= timestamp {
+			return &View{timestamp, cp.tree.revertedCopy(timestamp)}, nil
+		}
+	}
+
+	return nil, errors.New("asof: history before timestamp was truncated")
+}
@@ -0,0 +1,359 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package crdt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"udr-tree/network"
+
+	"github.com/google/uuid"
+	"github.com/vmihailenco/msgpack/v5"
+	"github.com/vmihailenco/msgpack/v5/msgpcode"
+)
+
+const CodecCompact = "compact"
+
+// banderas del codec compacto, el tipo de operacion va en los bits 4 y 5
+const (
+	flagName = 1 << iota
+	flagValue
+	flagOwners
+	flagSignature
+)
+
+// IDs que todas las replicas conocen, tienen los IDs cortos 1, 2 y 3
+var wellKnownIDs = []uuid.UUID{nilID, rootID, trashID}
+
+// Codec binario con campos en varint. Cada UUID se envia completo la
+// primera vez (ID corto 0) y despues con el ID corto que le asigna la
+// replica que lo envia. Necesita que el receptor vea todas las
+// operaciones de cada replica en orden, como ya exige la entrega causal
+type CompactCodec struct {
+	ids       map[uuid.UUID]uint64   // IDs cortos propios
+	peerIDs   map[uint64][]uuid.UUID // IDs cortos de cada replica
+	peerKnown map[peerID]bool        // IDs de peerIDs, ver frameReader.id
+}
+
+type peerID struct {
+	replica uint64
+	id      uuid.UUID
+}
+
+func NewCompactCodec() *CompactCodec {
+	codec := &CompactCodec{
+		ids:       make(map[uuid.UUID]uint64),
+		peerIDs:   make(map[uint64][]uuid.UUID),
+		peerKnown: make(map[peerID]bool),
+	}
+
+	for i, id := range wellKnownIDs {
+		codec.ids[id] = uint64(i + 1)
+	}
+
+	return codec
+}
+
+// IDs propios ordenados por ID corto, sin los IDs conocidos
+func (codec *CompactCodec) table() []uuid.UUID {
+	table := make([]uuid.UUID, len(codec.ids)-len(wellKnownIDs))
+	for id, short := range codec.ids {
+		if short > uint64(len(wellKnownIDs)) {
+			table[short-uint64(len(wellKnownIDs))-1] = id
+		}
+	}
+
+	return table
+}
+
+// Carga las tablas de un estado de otra replica, la tabla de self son
+// los IDs propios
+func (codec *CompactCodec) loadTables(self uint64, tables [NumReplicas][]uuid.UUID) {
+	for replica, table := range tables {
+		if uint64(replica) != self {
+			codec.peerIDs[uint64(replica)] = table
+			for _, id := range table {
+				codec.peerKnown[peerID{uint64(replica), id}] = true
+			}
+			continue
+		}
+
+		for i, id := range table {
+			codec.ids[id] = uint64(len(wellKnownIDs) + i + 1)
+		}
+	}
+}
+
+func (codec *CompactCodec) appendID(frame []byte, id uuid.UUID) []byte {
+	if short, ok := codec.ids[id]; ok {
+		return binary.AppendUvarint(frame, short)
+	}
+
+	codec.ids[id] = uint64(len(codec.ids) + 1)
+	frame = binary.AppendUvarint(frame, 0)
+	return append(frame, id[:]...)
+}
+
+func appendBytes(frame []byte, data []byte) []byte {
+	frame = binary.AppendUvarint(frame, uint64(len(data)))
+	return append(frame, data...)
+}
+
+// Codifica la operacion como un bin de MessagePack, asi el servidor y
+// las replicas la pueden separar de las operaciones en MessagePack
+func (codec *CompactCodec) Encode(op Operation) []byte {
+	frame := []byte{network.CompactMagic}
+	frame = appendBytes(frame, []byte(op.Document))
+	frame = binary.AppendUvarint(frame, op.ReplicaID)
+	frame = binary.AppendUvarint(frame, op.Timestamp)
+	flags := byte(op.Kind) << 4
+	if op.Name != "" {
+		flags |= flagName
+	}
+	if op.Value != nil {
+		flags |= flagValue
+	}
+	if op.Owners != nil {
+		flags |= flagOwners
+	}
+	if op.Signature != nil {
+		flags |= flagSignature
+	}
+
+	frame = append(frame, flags)
+	frame = codec.appendID(frame, op.Node)
+	frame = codec.appendID(frame, op.NewParent)
+	if op.Name != "" {
+		frame = appendBytes(frame, []byte(op.Name))
+	}
+	if op.Value != nil {
+		frame = appendBytes(frame, op.Value)
+	}
+	if op.Owners != nil {
+		frame = binary.AppendUvarint(frame, uint64(len(op.Owners)))
+		for _, owner := range op.Owners {
+			frame = binary.AppendUvarint(frame, owner)
+		}
+	}
+	if op.Signature != nil {
+		frame = appendBytes(frame, op.Signature)
+	}
+
+	data, err := msgpack.Marshal(frame)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return data
+}
+
+var errFrame = errors.New("invalid compact frame")
+
+// lector de un frame, el primer error se guarda y corta la lectura
+type frameReader struct {
+	frame []byte
+	err   error
+}
+
+func (r *frameReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+
+	x, n := binary.Uvarint(r.frame)
+	if n <= 0 {
+		r.err = errFrame
+		return 0
+	}
+
+	r.frame = r.frame[n:]
+	return x
+}
+
+func (r *frameReader) bytes(size uint64) []byte {
+	if r.err != nil {
+		return nil
+	} else if uint64(len(r.frame)) < size {
+		r.err = errFrame
+		return nil
+	}
+
+	data := r.frame[:size:size]
+	r.frame = r.frame[size:]
+	return data
+}
+
+func (r *frameReader) id(codec *CompactCodec, replica uint64) uuid.UUID {
+	short := r.uvarint()
+	table := codec.peerIDs[replica]
+	if short == 0 {
+		id, err := uuid.FromBytes(r.bytes(16))
+		if err != nil && r.err == nil {
+			r.err = err
+		}
+
+		// una operacion duplicada vuelve a definir un ID que ya tiene
+		if !codec.peerKnown[peerID{replica, id}] {
+			codec.peerKnown[peerID{replica, id}] = true
+			codec.peerIDs[replica] = append(table, id)
+		}
+		return id
+	} else if short <= uint64(len(wellKnownIDs)) {
+		return wellKnownIDs[short-1]
+	} else if short-uint64(len(wellKnownIDs)) > uint64(len(table)) {
+		if r.err == nil {
+			r.err = errors.New("unknown compact id, operations were lost")
+		}
+
+		return nilID
+	}
+
+	return table[short-uint64(len(wellKnownIDs))-1]
+}
+
+// Decodifica un bin de MessagePack creado por Encode en otra replica
+func (codec *CompactCodec) Decode(data []byte) (Operation, error) {
+	var op Operation
+	frame, err := msgpack.NewDecoder(bytes.NewReader(data)).DecodeBytes()
+	if err != nil {
+		return op, err
+	} else if len(frame) == 0 || frame[0] != network.CompactMagic {
+		return op, errFrame
+	}
+
+	r := &frameReader{frame: frame[1:]}
+	op.Document = string(r.bytes(r.uvarint()))
+	op.ReplicaID = r.uvarint()
+	op.Timestamp = r.uvarint()
+	flags := r.bytes(1)
+	if r.err != nil {
+		return op, r.err
+	}
+
+	op.Kind = OpKind(flags[0] >> 4)
+	op.Node = r.id(codec, op.ReplicaID)
+	op.NewParent = r.id(codec, op.ReplicaID)
+	if flags[0]&flagName != 0 {
+		op.Name = string(r.bytes(r.uvarint()))
+	}
+	if flags[0]&flagValue != 0 {
+		op.Value = r.bytes(r.uvarint())
+	}
+	if flags[0]&flagOwners != 0 {
+		n := r.uvarint()
+		op.Owners = []uint64{}
+		for i := uint64(0); i < n && r.err == nil; i++ {
+			op.Owners = append(op.Owners, r.uvarint())
+		}
+	}
+	if flags[0]&flagSignature != 0 {
+		op.Signature = r.bytes(r.uvarint())
+	}
+
+	return op, r.err
+}
+
+// Usa el codec compacto con las replicas que tambien lo activaron. Se
+// anuncia a las demas replicas del documento y solo se empieza a usar
+// cuando todas lo anunciaron, las operaciones recibidas se leen en
+// cualquiera de los dos formatos
+func (tree *Tree) EnableCompactCodec() {
+	tree.Lock()
+	defer tree.Unlock()
+
+	tree.compact = true
+	tree.announceCodecs()
+}
+
+func (tree *Tree) announceCodecs() {
+	tree.conn.Send(network.CapabilitiesMessage(network.Capabilities{
+		ReplicaID: tree.id,
+		Document:  tree.doc,
+		Codecs:    []string{CodecCompact},
+	}))
+}
+
+func (tree *Tree) useCompact() bool {
+	if !tree.compact {
+		return false
+	}
+
+	for id, ok := range tree.peerCompact {
+		if uint64(id) != tree.id && !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (tree *Tree) encode(op Operation) []byte {
+	if tree.useCompact() {
+		return tree.codec.Encode(op)
+	}
+
+	return OperationToBytes(op)
+}
+
+func (tree *Tree) receiveCapabilities(data []byte) {
+	var caps network.Capabilities
+	if err := msgpack.Unmarshal(data, &caps); err != nil || caps.ReplicaID >= NumReplicas {
+		log.Println("invalid capabilities message")
+		return
+	}
+
+	known := tree.peerCompact[caps.ReplicaID]
+	for _, codec := range caps.Codecs {
+		if codec == CodecCompact {
+			tree.peerCompact[caps.ReplicaID] = true
+		}
+	}
+
+	// la replica que recien se anuncia no escucho nuestro anuncio
+	if tree.compact && !known {
+		tree.announceCodecs()
+	}
+}
+
+// Separa las operaciones de un paquete, en MessagePack o en el codec
+// compacto. Si una operacion no se puede leer se descarta el paquete
+// entero
+func (tree *Tree) decode(data []byte) ([]Operation, error) {
+	var ops []Operation
+	dec := msgpack.NewDecoder(bytes.NewReader(data))
+	for {
+		code, err := dec.PeekCode()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		raw, err := dec.DecodeRaw()
+		if err != nil {
+			return nil, err
+		}
+
+		var op Operation
+		if msgpcode.IsBin(code) {
+			op, err = tree.codec.Decode(raw)
+		} else {
+			err = msgpack.Unmarshal(raw, &op)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		ops = append(ops, op)
+	}
+
+	return ops, nil
+}
@@ -0,0 +1,222 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package crdt
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/google/uuid"
+)
+
+type ChangeKind string
+
+const (
+	Created ChangeKind = "created"
+	Moved   ChangeKind = "moved"
+	Renamed ChangeKind = "renamed"
+	Trashed ChangeKind = "trashed"
+	Removed ChangeKind = "removed" // no existe en to, solo si to es anterior
+	Valued  ChangeKind = "value"   // solo cambio el valor
+)
+
+// Cambio de un nodo entre dos estados del arbol. Los padres se
+// guardan por nombre para que el diff sea legible
+type Change struct {
+	Kind      ChangeKind `json:"kind"`
+	Node      uuid.UUID  `json:"node"`
+	Name      string     `json:"name"`
+	OldName   string     `json:"old_name,omitempty"`
+	Parent    string     `json:"parent,omitempty"`
+	OldParent string     `json:"old_parent,omitempty"`
+	Value     []byte     `json:"value,omitempty"`
+	OldValue  []byte     `json:"old_value,omitempty"`
+}
+
+// Vista del estado actual del arbol
+func (tree *Tree) Snapshot() *View {
+	tree.RLock()
+	defer tree.RUnlock()
+
+	return &View{tree.localTime - 1, tree.clone()}
+}
+
+// Diff del mismo arbol entre dos tiempos de Lamport
+func (tree *Tree) Diff(from, to uint64) ([]Change, error) {
+	fromView, err := tree.AsOf(from)
+	if err != nil {
+		return nil, err
+	}
+
+	toView, err := tree.AsOf(to)
+	if err != nil {
+		return nil, err
+	}
+
+	return Diff(fromView, toView), nil
+}
+
+// ubicacion de un nodo: dentro de root, dentro de la papelera o ninguna
+func (tree *Tree) location(id uuid.UUID) (live, trashed bool) {
+	if !tree.exists(id) {
+		return false, false
+	}
+
+	return tree.descendant(id, rootID), tree.descendant(id, trashID)
+}
+
+// Lista minima de cambios para pasar de from a to. Los cambios se
+// ordenan recorriendo to, asi un padre creado aparece antes que sus hijos
+func Diff(from, to *View) []Change {
+	var changes []Change
+	visited := make(map[uuid.UUID]bool)
+	var walk func(node *treeNode)
+	walk = func(node *treeNode) {
+		visited[node.id] = true
+		if change, ok := diffNode(from.tree, to.tree, node.id); ok {
+			changes = append(changes, change)
+		}
+
+		for _, child := range sortedChildren(node) {
+			walk(child)
+		}
+	}
+
+	for _, child := range sortedChildren(to.tree.nodes[rootID]) {
+		walk(child)
+	}
+
+	for _, child := range sortedChildren(to.tree.nodes[trashID]) {
+		walk(child)
+	}
+
+	// nodos que estaban en from y no existen en to, from es posterior
+	var walkFrom func(node *treeNode)
+	walkFrom = func(node *treeNode) {
+		if !visited[node.id] {
+			changes = append(changes, Change{
+				Kind:      Removed,
+				Node:      node.id,
+				Name:      node.name,
+				OldParent: node.parent.name,
+			})
+			return
+		}
+
+		for _, child := range sortedChildren(node) {
+			walkFrom(child)
+		}
+	}
+
+	for _, child := range sortedChildren(from.tree.nodes[rootID]) {
+		walkFrom(child)
+	}
+
+	return changes
+}
+
+func sortedChildren(node *treeNode) []*treeNode {
+	children := append([]*treeNode(nil), node.children...)
+	sort.Slice(children, func(i, j int) bool {
+		return children[i].name < children[j].name
+	})
+
+	return children
+}
+
+func diffNode(from, to *Tree, id uuid.UUID) (Change, bool) {
+	node := to.nodes[id]
+	change := Change{Node: id, Name: node.name, Parent: node.parent.name, Value: node.value}
+	fromLive, fromTrashed := from.location(id)
+	toLive, _ := to.location(id)
+	if !fromLive && !fromTrashed {
+		// creado y borrado entre from y to no se reporta
+		change.Kind = Created
+		return change, toLive
+	} else if !toLive && !fromLive {
+		return change, false
+	}
+
+	// un nodo movido y renombrado se reporta como movido con OldName
+	old := from.nodes[id]
+	if old.name != node.name {
+		change.OldName = old.name
+	}
+
+	valued := !bytes.Equal(old.value, node.value)
+	if valued {
+		change.OldValue = old.value
+	} else {
+		change.Value = nil
+	}
+
+	if old.parent.id != node.parent.id {
+		change.OldParent = old.parent.name
+		if node.parent.id == trashID {
+			change.Kind = Trashed
+			change.Parent = ""
+		} else {
+			change.Kind = Moved
+		}
+
+		return change, true
+	} else if old.name != node.name {
+		change.Kind = Renamed
+		change.Parent = ""
+		return change, true
+	} else if valued {
+		change.Kind = Valued
+		change.Parent = ""
+		return change, true
+	}
+
+	return change, false
+}
+
+func WriteDiffText(w io.Writer, changes []Change) error {
+	for _, change := range changes {
+		name := change.Name
+		if change.OldName != "" && change.Kind != Renamed {
+			name = change.OldName + " -> " + change.Name
+		}
+
+		var err error
+		switch change.Kind {
+		case Created:
+			_, err = fmt.Fprintf(w, "+ %s (%s)\n", name, change.Parent)
+		case Moved:
+			_, err = fmt.Fprintf(w, "~ %s (%s -> %s)\n", name, change.OldParent, change.Parent)
+		case Renamed:
+			_, err = fmt.Fprintf(w, "= %s -> %s\n", change.OldName, change.Name)
+		case Trashed:
+			_, err = fmt.Fprintf(w, "- %s (%s)\n", name, change.OldParent)
+		case Removed:
+			_, err = fmt.Fprintf(w, "x %s (%s)\n", name, change.OldParent)
+		case Valued:
+			_, err = fmt.Fprintf(w, "* %s\n", name)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func WriteDiffJSON(w io.Writer, changes []Change) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if changes == nil {
+		changes = []Change{}
+	}
+
+	return enc.Encode(changes)
+}
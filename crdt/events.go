@@ -0,0 +1,137 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package crdt
+
+import (
+	"log"
+	"udr-tree/network"
+)
+
+type EventKind string
+
+const (
+	EventAdd    EventKind = "add"
+	EventMove   EventKind = "move"
+	EventRemove EventKind = "remove"
+	EventValue  EventKind = "value"
+	EventOwners EventKind = "owners"
+	EventRename EventKind = "rename"
+	EventReload EventKind = "reload" // el arbol se reemplazo por un estado recibido
+	// cambio el estado de la conexion, ver Tree.ConnectionState
+	EventConnection EventKind = "connection"
+)
+
+// Operacion aplicada al arbol o cambio de la conexion. Parent es el padre del nodo despues de
+// aplicarla, puede no ser el de la operacion si otra operacion concurrente
+// gano o si la operacion se ignoro
+type Event struct {
+	Kind    EventKind `json:"kind"`
+	Time    uint64    `json:"time"`
+	Replica uint64    `json:"replica"`
+	Local   bool      `json:"local"`
+	Node    string    `json:"node,omitempty"`
+	Parent  string    `json:"parent,omitempty"`
+	State   string    `json:"state,omitempty"`
+}
+
+// Recibe los eventos de las operaciones aplicadas desde ahora. Un
+// suscriptor que no lee a tiempo pierde la suscripcion y su canal se
+// cierra, debe volver a leer el arbol y suscribirse de nuevo
+func (tree *Tree) Subscribe(buffer int) (<-chan Event, func()) {
+	tree.Lock()
+	defer tree.Unlock()
+
+	ch := make(chan Event, buffer)
+	if tree.subscribers == nil {
+		tree.subscribers = make(map[chan Event]bool)
+	}
+
+	tree.subscribers[ch] = true
+	cancel := func() {
+		tree.Lock()
+		defer tree.Unlock()
+
+		if tree.subscribers[ch] {
+			delete(tree.subscribers, ch)
+			close(ch)
+		}
+	}
+
+	return ch, cancel
+}
+
+// se llama con el lock tomado despues de aplicar ops
+func (tree *Tree) notify(ops []Operation) {
+	if len(tree.subscribers) == 0 {
+		return
+	}
+
+	for _, op := range ops {
+		event := Event{
+			Kind:    EventMove,
+			Time:    op.Timestamp,
+			Replica: op.ReplicaID,
+			Local:   op.ReplicaID == tree.id,
+		}
+
+		switch {
+		case op.Kind == KindOwners:
+			event.Kind = EventOwners
+		case op.Kind == KindRename:
+			event.Kind = EventRename
+		case op.Kind == KindValue:
+			event.Kind = EventValue
+		case op.NewParent == trashID:
+			event.Kind = EventRemove
+		case op.Name != "":
+			event.Kind = EventAdd
+		}
+
+		if node, ok := tree.nodes[op.Node]; ok {
+			event.Node = node.name
+			if node.parent != nil {
+				event.Parent = node.parent.name
+			}
+		}
+
+		tree.publish(event)
+	}
+}
+
+// se llama con el lock tomado
+func (tree *Tree) publish(event Event) {
+	for ch := range tree.subscribers {
+		select {
+		case ch <- event:
+		default:
+			delete(tree.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// La conexion avisa cuando se pierde o se recupera, ver
+// network.StateListener
+func (tree *Tree) ConnectionState(state network.ConnState) {
+	tree.Lock()
+	defer tree.Unlock()
+
+	if tree.connState != state {
+		log.Println("replica", tree.id, "is", state)
+	}
+
+	tree.connState = state
+	tree.publish(Event{Kind: EventConnection, Time: tree.localTime - 1, State: state.String()})
+}
+
+// Estado de la conexion con el servidor
+func (tree *Tree) ConnState() network.ConnState {
+	tree.RLock()
+	defer tree.RUnlock()
+
+	return tree.connState
+}
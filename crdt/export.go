@@ -0,0 +1,200 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package crdt
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+type Format string
+
+const (
+	FormatJSON Format = "json"
+	FormatDOT  Format = "dot"
+	FormatYAML Format = "yaml"
+	FormatCSV  Format = "csv"
+)
+
+type ExportOptions struct {
+	Trash bool // incluir la papelera
+	IDs   bool // incluir los UUID de los nodos
+}
+
+// Nodo en el formato JSON anidado
+type exportNode struct {
+	ID       string        `json:"id,omitempty"`
+	Name     string        `json:"name"`
+	Children []*exportNode `json:"children,omitempty"`
+}
+
+func ParseFormat(name string) (Format, error) {
+	switch format := Format(strings.ToLower(name)); format {
+	case FormatJSON, FormatDOT, FormatYAML, FormatCSV:
+		return format, nil
+	}
+
+	return "", errors.New("export: unknown format " + name)
+}
+
+// Serializa el arbol en el formato dado. En JSON la raiz es un objeto,
+// o un arreglo con root y la papelera si se incluye la papelera
+func (tree *Tree) Export(w io.Writer, format Format, opts ExportOptions) error {
+	tree.RLock()
+	defer tree.RUnlock()
+
+	roots := []*treeNode{tree.nodes[rootID]}
+	if opts.Trash {
+		roots = append(roots, tree.nodes[trashID])
+	}
+
+	return export(w, roots, format, opts)
+}
+
+// Como Export pero solo el subarbol de name, sin la papelera
+func (tree *Tree) ExportSubtree(w io.Writer, name string, format Format, opts ExportOptions) error {
+	tree.RLock()
+	defer tree.RUnlock()
+
+	id, ok := tree.names[name]
+	if !ok {
+		return errors.New("export: node does not exist")
+	}
+
+	return export(w, []*treeNode{tree.nodes[id]}, format, opts)
+}
+
+func export(w io.Writer, roots []*treeNode, format Format, opts ExportOptions) error {
+	buf := bufio.NewWriter(w)
+	var err error
+	switch format {
+	case FormatJSON:
+		err = exportJSON(buf, roots, opts)
+	case FormatDOT:
+		err = exportDOT(buf, roots, opts)
+	case FormatYAML:
+		err = exportYAML(buf, roots, opts)
+	case FormatCSV:
+		err = exportCSV(buf, roots)
+	default:
+		err = errors.New("export: unknown format " + string(format))
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return buf.Flush()
+}
+
+func (view *View) Export(w io.Writer, format Format, opts ExportOptions) error {
+	return view.tree.Export(w, format, opts)
+}
+
+func toExportNode(node *treeNode, opts ExportOptions) *exportNode {
+	exp := &exportNode{Name: node.name}
+	if opts.IDs {
+		exp.ID = node.id.String()
+	}
+
+	for _, child := range sortedChildren(node) {
+		exp.Children = append(exp.Children, toExportNode(child, opts))
+	}
+
+	return exp
+}
+
+func exportJSON(w io.Writer, roots []*treeNode, opts ExportOptions) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if len(roots) == 1 {
+		return enc.Encode(toExportNode(roots[0], opts))
+	}
+
+	var nodes []*exportNode
+	for _, root := range roots {
+		nodes = append(nodes, toExportNode(root, opts))
+	}
+
+	return enc.Encode(nodes)
+}
+
+func exportDOT(w io.Writer, roots []*treeNode, opts ExportOptions) error {
+	// los nombres son unicos, asi que sirven como identificadores
+	id := func(node *treeNode) string {
+		if opts.IDs {
+			return node.id.String()
+		}
+
+		return node.name
+	}
+
+	var walk func(node *treeNode)
+	walk = func(node *treeNode) {
+		fmt.Fprintf(w, "\t%q [label=%q];\n", id(node), node.name)
+		for _, child := range sortedChildren(node) {
+			fmt.Fprintf(w, "\t%q -> %q;\n", id(node), id(child))
+			walk(child)
+		}
+	}
+
+	fmt.Fprintln(w, "digraph tree {")
+	for _, root := range roots {
+		walk(root)
+	}
+
+	_, err := fmt.Fprintln(w, "}")
+	return err
+}
+
+func exportYAML(w io.Writer, roots []*treeNode, opts ExportOptions) error {
+	var walk func(node *treeNode, indent string)
+	walk = func(node *treeNode, indent string) {
+		fmt.Fprintf(w, "%s- name: %q\n", indent, node.name)
+		if opts.IDs {
+			fmt.Fprintf(w, "%s  id: %s\n", indent, node.id)
+		}
+
+		if len(node.children) > 0 {
+			fmt.Fprintf(w, "%s  children:\n", indent)
+			for _, child := range sortedChildren(node) {
+				walk(child, indent+"    ")
+			}
+		}
+	}
+
+	for _, root := range roots {
+		walk(root, "")
+	}
+
+	return nil
+}
+
+// En CSV siempre se incluyen los UUID, la raiz no tiene padre
+func exportCSV(w io.Writer, roots []*treeNode) error {
+	out := csv.NewWriter(w)
+	out.Write([]string{"id", "parent", "name"})
+	var walk func(node *treeNode, parent string)
+	walk = func(node *treeNode, parent string) {
+		out.Write([]string{node.id.String(), parent, node.name})
+		for _, child := range sortedChildren(node) {
+			walk(child, node.id.String())
+		}
+	}
+
+	for _, root := range roots {
+		walk(root, "")
+	}
+
+	out.Flush()
+	return out.Error()
+}
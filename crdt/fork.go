@@ -0,0 +1,151 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package crdt
+
+import (
+	"errors"
+	"time"
+	"udr-tree/network"
+
+	"github.com/google/uuid"
+)
+
+// Conflicto encontrado al reaplicar una operacion de un fork
+type Conflict struct {
+	Op     Operation
+	Reason string
+}
+
+// Conexion de un fork, no transmite nada y solo guarda las
+// operaciones locales para reaplicarlas en MergeFork
+type detachedConn struct {
+	sent [][]byte
+}
+
+func (conn *detachedConn) Send(data []byte) {
+	if env, err := network.ReadEnvelope(data); err == nil && env.Type == network.TypeOperation {
+		conn.sent = append(conn.sent, env.Payload)
+	}
+}
+
+func (conn *detachedConn) Connect()    {}
+func (conn *detachedConn) Disconnect() {}
+func (conn *detachedConn) Close()      {}
+
+// copia profunda del arbol, sin conexion ni estadisticas
+func (tree *Tree) clone() *Tree {
+	dup := &Tree{
+		id:        tree.id,
+		doc:       tree.doc,
+		localTime: tree.localTime,
+		time:      tree.time,
+		nodes:     make(map[uuid.UUID]*treeNode, len(tree.nodes)),
+		names:     make(map[string]uuid.UUID, len(tree.names)),
+		history:   append([]LogOperation(nil), tree.history...),
+		conn:      &detachedConn{},
+
+		// el historial anterior no esta, ver AsOf
+		truncatedAt: tree.truncatedAt,
+	}
+
+	for id, node := range tree.nodes {
+		dup.nodes[id] = &treeNode{
+			id:    node.id,
+			name:  node.name,
+			value: node.value,
+		}
+	}
+
+	// los punteros se arreglan despues de crear todos los nodos
+	for id, node := range tree.nodes {
+		dupNode := dup.nodes[id]
+		if node.parent != nil {
+			dupNode.parent = dup.nodes[node.parent.id]
+		}
+
+		dupNode.owners = node.owners
+		dupNode.children = make([]*treeNode, len(node.children))
+		for i, child := range node.children {
+			dupNode.children[i] = dup.nodes[child.id]
+		}
+	}
+
+	for name, id := range tree.names {
+		dup.names[name] = id
+	}
+
+	return dup
+}
+
+// Crea una copia desconectada del arbol que comparte el historial.
+// Las operaciones hechas en el fork no se transmiten hasta MergeFork
+func (tree *Tree) Fork() *Tree {
+	tree.RLock()
+	defer tree.RUnlock()
+
+	fork := tree.clone()
+	fork.origin = tree
+	return fork
+}
+
+// Reaplica las operaciones del fork en el arbol con timestamps nuevos,
+// pasando por apply() como cualquier operacion local. Devuelve las
+// operaciones que no se pudieron aplicar o que fueron ignoradas
+func (tree *Tree) MergeFork(fork *Tree) ([]Conflict, error) {
+	if fork.origin != tree {
+		return nil, errors.New("merge: tree is not a fork of this tree")
+	}
+
+	fork.Lock()
+	conn := fork.conn.(*detachedConn)
+	sent := conn.sent
+	conn.sent = nil
+	fork.Unlock()
+
+	tree.Lock()
+	defer tree.Unlock()
+
+	var forkOps []Operation
+	for _, data := range sent {
+		forkOps = append(forkOps, OperationsFromBytes(data)...)
+	}
+
+	var conflicts []Conflict
+	for _, forkOp := range forkOps {
+		op := Operation{
+			ReplicaID: tree.id,
+			Timestamp: tree.localTime,
+			NewParent: forkOp.NewParent,
+			Node:      forkOp.Node,
+			Name:      forkOp.Name,
+			Value:     forkOp.Value,
+			Kind:      forkOp.Kind,
+			Owners:    forkOp.Owners,
+			time:      time.Now(),
+		}
+
+		if id, ok := tree.names[op.Name]; ok && op.Name != "" && id != op.Node {
+			conflicts = append(conflicts, Conflict{forkOp, "name already exists"})
+			continue
+		} else if op.Name == "" && !tree.exists(op.Node) {
+			conflicts = append(conflicts, Conflict{forkOp, "node does not exist"})
+			continue
+		} else if op.Kind == KindMove && !tree.exists(op.NewParent) {
+			conflicts = append(conflicts, Conflict{forkOp, "parent does not exist"})
+			continue
+		}
+
+		tree.apply(op)
+		// la operacion tiene el mayor timestamp, queda al final del historial
+		last := tree.history[len(tree.history)-1]
+		if last.ignored {
+			conflicts = append(conflicts, Conflict{forkOp, "ignored: cycle or permission denied"})
+		}
+	}
+
+	return conflicts, nil
+}
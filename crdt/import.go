@@ -0,0 +1,259 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package crdt
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"time"
+	"udr-tree/network"
+
+	"github.com/google/uuid"
+)
+
+// Nodo de una jerarquia a importar
+type importNode struct {
+	name     string
+	children []*importNode
+}
+
+// Importa una jerarquia JSON (como la de Export) o CSV (id,parent,name)
+// como hijos de parent. Si la raiz de la jerarquia se llama igual que
+// parent se importan sus hijos. Devuelve la cantidad de nodos creados
+func (tree *Tree) Import(r io.Reader, format Format, parent string) (int, error) {
+	var roots []*importNode
+	var err error
+	switch format {
+	case FormatJSON:
+		roots, err = importJSON(r)
+	case FormatCSV:
+		roots, err = importCSV(r)
+	default:
+		err = errors.New("import: unsupported format " + string(format))
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	return tree.importNodes(roots, parent)
+}
+
+// Importa los subdirectorios de path como hijos de parent
+func (tree *Tree) ImportDir(path, parent string) (int, error) {
+	nodes := make(map[string]*importNode)
+	var roots []*importNode
+	err := filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		} else if !d.IsDir() || p == path {
+			return nil
+		}
+
+		node := &importNode{name: d.Name()}
+		nodes[p] = node
+		if dir, ok := nodes[filepath.Dir(p)]; ok {
+			dir.children = append(dir.children, node)
+		} else {
+			roots = append(roots, node)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	return tree.importNodes(roots, parent)
+}
+
+func importJSON(r io.Reader) ([]*importNode, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var exps []*exportNode
+	data = bytes.TrimSpace(data)
+	if len(data) > 0 && data[0] == '{' {
+		exps = []*exportNode{{}}
+		err = json.Unmarshal(data, exps[0])
+	} else {
+		err = json.Unmarshal(data, &exps)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	var convert func(exp *exportNode) *importNode
+	convert = func(exp *exportNode) *importNode {
+		node := &importNode{name: exp.Name}
+		for _, child := range exp.Children {
+			node.children = append(node.children, convert(child))
+		}
+
+		return node
+	}
+
+	var roots []*importNode
+	for _, exp := range exps {
+		roots = append(roots, convert(exp))
+	}
+
+	return roots, nil
+}
+
+// Las filas cuyo padre no aparece en el archivo son raices
+func importCSV(r io.Reader) ([]*importNode, error) {
+	records, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(records) > 0 && records[0][0] == "id" {
+		records = records[1:]
+	}
+
+	nodes := make(map[string]*importNode)
+	for _, record := range records {
+		if len(record) != 3 {
+			return nil, errors.New("import: csv rows must be id,parent,name")
+		}
+
+		nodes[record[0]] = &importNode{name: record[2]}
+	}
+
+	var roots []*importNode
+	for _, record := range records {
+		if parent, ok := nodes[record[1]]; ok {
+			parent.children = append(parent.children, nodes[record[0]])
+		} else {
+			roots = append(roots, nodes[record[0]])
+		}
+	}
+
+	// las filas que no se alcanzan desde una raiz estan en un ciclo
+	reached := make(map[*importNode]bool)
+	var walk func(node *importNode)
+	walk = func(node *importNode) {
+		reached[node] = true
+		for _, child := range node.children {
+			walk(child)
+		}
+	}
+
+	for _, root := range roots {
+		walk(root)
+	}
+
+	var cycle []string
+	for _, record := range records {
+		if !reached[nodes[record[0]]] {
+			cycle = append(cycle, record[0])
+		}
+	}
+
+	if len(cycle) > 0 {
+		return nil, errors.New("import: csv rows form a cycle: " + strings.Join(cycle, ", "))
+	}
+
+	return roots, nil
+}
+
+func (tree *Tree) importNodes(roots []*importNode, parent string) (int, error) {
+	tree.Lock()
+	defer tree.Unlock()
+
+	parentID, ok := tree.names[parent]
+	if !ok {
+		return 0, errors.New("import: parent does not exist")
+	} else if !tree.allowed(tree.id, parentID) {
+		return 0, errors.New("import: permission denied")
+	}
+
+	if len(roots) == 1 && roots[0].name == parent {
+		roots = roots[0].children
+	}
+
+	// se validan todos los nombres antes de crear alguna operacion
+	var ops []Operation
+	names := make(map[string]bool)
+	var walk func(node *importNode, parentID uuid.UUID) error
+	walk = func(node *importNode, parentID uuid.UUID) error {
+		if _, ok := tree.names[node.name]; ok || names[node.name] {
+			return errors.New("import: name already exists: " + node.name)
+		}
+
+		names[node.name] = true
+		op := Operation{
+			ReplicaID: tree.id,
+			Timestamp: tree.localTime + uint64(len(ops)),
+			NewParent: parentID,
+			Node:      uuid.New(),
+			Name:      node.name,
+			time:      time.Now(),
+		}
+
+		ops = append(ops, op)
+		for _, child := range node.children {
+			if err := walk(child, op.Node); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	for _, root := range roots {
+		if err := walk(root, parentID); err != nil {
+			return 0, err
+		}
+	}
+
+	if len(ops) > 0 {
+		tree.applyLocalBatch(ops)
+	}
+
+	return len(ops), nil
+}
+
+// Camino rapido para operaciones locales ya ordenadas: todas tienen un
+// timestamp mayor a cualquier operacion del historial, asi que no hace
+// falta revertir nada. Se transmiten juntas en un solo paquete
+func (tree *Tree) applyLocalBatch(ops []Operation) {
+	var data []byte
+	for _, op := range ops {
+		tree.createNode(op)
+		tree.history = append(tree.history, LogOperation{
+			ReplicaID: op.ReplicaID,
+			Timestamp: op.Timestamp,
+			NewParent: op.NewParent,
+			Node:      op.Node,
+		})
+
+		tree.reapply(&tree.history[len(tree.history)-1])
+		tree.LocalCnt++
+		tree.LocalSum += time.Since(op.time)
+		op.Document = tree.doc
+		tree.sign(&op)
+		data = append(data, tree.encode(op)...)
+		tree.time[op.ReplicaID] = Max(tree.time[op.ReplicaID], op.Timestamp)
+		tree.localTime = Max(tree.localTime, op.Timestamp) + 1
+	}
+
+	tree.PacketSzSum += uint64(len(data))
+	tree.conn.Send(network.OperationMessage(tree.doc, data))
+	tree.notify(ops)
+}
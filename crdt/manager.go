@@ -0,0 +1,164 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package crdt
+
+import (
+	"crypto/ed25519"
+	"log"
+	"sync"
+	"time"
+	"udr-tree/network"
+)
+
+// Mantiene varios arboles (documentos) que comparten una conexion. Cada
+// operacion lleva el documento al que pertenece y el servidor solo la
+// envia a las replicas que abrieron ese documento
+type Manager struct {
+	sync.Mutex
+	id    int
+	conn  network.ReplicaConn
+	trees map[string]*Tree
+	// firma de operaciones de todos los documentos
+	signKey ed25519.PrivateKey
+	keys    *KeyRegistry
+}
+
+// Conexion de un documento, la conexion compartida la maneja el Manager
+type docConn struct {
+	conn network.ReplicaConn
+}
+
+func (conn docConn) Send(data []byte) {
+	conn.conn.Send(data)
+}
+
+func (conn docConn) Connect()    {}
+func (conn docConn) Disconnect() {}
+func (conn docConn) Close()      {}
+
+func NewManager(id int, serverIP string) *Manager {
+	return NewManagerWithConn(id, func(m network.CRDTTree) network.ReplicaConn {
+		return network.NewCausalConn(m, serverIP)
+	})
+}
+
+func NewManagerWithConn(id int, dial func(network.CRDTTree) network.ReplicaConn) *Manager {
+	manager := &Manager{
+		id:    id,
+		trees: make(map[string]*Tree),
+	}
+
+	// ver NewTreeWithConn
+	manager.Lock()
+	manager.conn = dial(manager)
+	manager.Unlock()
+	// Esperar a que las demas replicas se inicien
+	time.Sleep(5 * time.Second)
+	return manager
+}
+
+// Devuelve el arbol del documento doc, creandolo si no existe
+func (manager *Manager) Open(doc string) *Tree {
+	manager.Lock()
+	defer manager.Unlock()
+
+	if tree, ok := manager.trees[doc]; ok {
+		return tree
+	}
+
+	tree := newTree(manager.id, doc)
+	tree.conn = docConn{manager.conn}
+	tree.signKey = manager.signKey
+	tree.keys = manager.keys
+	tree.startTruncating()
+	manager.trees[doc] = tree
+	manager.conn.Send(network.SubscribeMessage(doc))
+	return tree
+}
+
+// Firma las operaciones de todos los documentos, ver Tree.EnableSigning
+func (manager *Manager) EnableSigning(key ed25519.PrivateKey, registry *KeyRegistry) {
+	manager.Lock()
+	defer manager.Unlock()
+
+	manager.signKey = key
+	manager.keys = registry
+	for _, tree := range manager.trees {
+		tree.EnableSigning(key, registry)
+	}
+}
+
+func (manager *Manager) Documents() []string {
+	manager.Lock()
+	defer manager.Unlock()
+
+	var docs []string
+	for doc := range manager.trees {
+		docs = append(docs, doc)
+	}
+
+	return docs
+}
+
+func (manager *Manager) GetID() int {
+	return manager.id
+}
+
+func (manager *Manager) ApplyRemoteOperation(data []byte) {
+	manager.ApplyRemoteOperations([][]byte{data})
+}
+
+// Las operaciones de un paquete son todas del mismo documento, los
+// paquetes se agrupan por documento manteniendo su orden
+func (manager *Manager) ApplyRemoteOperations(packets [][]byte) {
+	var docs []string
+	byDoc := make(map[string][][]byte)
+	for _, data := range packets {
+		env, err := network.ReadEnvelope(data)
+		if err != nil {
+			log.Println("manager:", err)
+			continue
+		}
+
+		if _, ok := byDoc[env.Document]; !ok {
+			docs = append(docs, env.Document)
+		}
+
+		byDoc[env.Document] = append(byDoc[env.Document], data)
+	}
+
+	for _, doc := range docs {
+		manager.Lock()
+		tree, ok := manager.trees[doc]
+		manager.Unlock()
+		if ok {
+			tree.ApplyRemoteOperations(byDoc[doc])
+		}
+	}
+}
+
+// todos los documentos comparten la conexion
+func (manager *Manager) ConnectionState(state network.ConnState) {
+	manager.Lock()
+	defer manager.Unlock()
+
+	for _, tree := range manager.trees {
+		tree.ConnectionState(state)
+	}
+}
+
+func (manager *Manager) Connect() {
+	manager.conn.Connect()
+}
+
+func (manager *Manager) Disconnect() {
+	manager.conn.Disconnect()
+}
+
+func (manager *Manager) Close() {
+	manager.conn.Close()
+}
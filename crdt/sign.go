@@ -0,0 +1,149 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package crdt
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Claves publicas de confianza de cada replica
+type KeyRegistry struct {
+	sync.Mutex
+	keys map[uint64]ed25519.PublicKey
+}
+
+func NewKeyRegistry() *KeyRegistry {
+	return &KeyRegistry{keys: make(map[uint64]ed25519.PublicKey)}
+}
+
+func (registry *KeyRegistry) Add(replica uint64, key ed25519.PublicKey) {
+	registry.Lock()
+	defer registry.Unlock()
+
+	registry.keys[replica] = key
+}
+
+func (registry *KeyRegistry) Get(replica uint64) (ed25519.PublicKey, bool) {
+	registry.Lock()
+	defer registry.Unlock()
+
+	key, ok := registry.keys[replica]
+	return key, ok
+}
+
+// Lee un registro con una linea "[id] [clave publica en base64]" por
+// replica, las lineas que empiezan con # se ignoran
+func LoadKeyRegistry(path string) (*KeyRegistry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+	registry := NewKeyRegistry()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		} else if len(fields) != 2 {
+			return nil, errors.New("keys: invalid registry line")
+		}
+
+		replica, err := strconv.ParseUint(fields[0], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+
+		key, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil {
+			return nil, err
+		} else if len(key) != ed25519.PublicKeySize {
+			return nil, errors.New("keys: invalid public key size")
+		}
+
+		registry.Add(replica, ed25519.PublicKey(key))
+	}
+
+	return registry, scanner.Err()
+}
+
+// El archivo de la clave privada guarda la semilla en base64
+func LoadPrivateKey(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	seed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, err
+	} else if len(seed) != ed25519.SeedSize {
+		return nil, errors.New("keys: invalid private key size")
+	}
+
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// Genera una clave privada en path y devuelve la clave publica en base64
+// para agregarla al registro de las demas replicas
+func GeneratePrivateKey(path string) (string, error) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", err
+	}
+
+	seed := base64.StdEncoding.EncodeToString(private.Seed())
+	if err := os.WriteFile(path, []byte(seed+"\n"), 0600); err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(public), nil
+}
+
+// Firma las operaciones locales con key y solo acepta operaciones remotas
+// firmadas por la clave de registry para su replica
+func (tree *Tree) EnableSigning(key ed25519.PrivateKey, registry *KeyRegistry) {
+	tree.Lock()
+	defer tree.Unlock()
+
+	tree.signKey = key
+	tree.keys = registry
+}
+
+// se firma la operacion serializada sin la firma
+func (tree *Tree) sign(op *Operation) {
+	if tree.signKey == nil {
+		return
+	}
+
+	op.Signature = nil
+	op.Signature = ed25519.Sign(tree.signKey, OperationToBytes(*op))
+}
+
+func (tree *Tree) verify(op Operation) bool {
+	if tree.keys == nil {
+		return true
+	}
+
+	key, ok := tree.keys.Get(op.ReplicaID)
+	if !ok || len(op.Signature) != ed25519.SignatureSize {
+		return false
+	}
+
+	signature := op.Signature
+	op.Signature = nil
+	return ed25519.Verify(key, OperationToBytes(op), signature)
+}
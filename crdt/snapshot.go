@@ -0,0 +1,196 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package crdt
+
+import (
+	"errors"
+	"log"
+	"time"
+	"udr-tree/network"
+
+	"github.com/google/uuid"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Estado completo de una replica que el servidor entrega a las replicas
+// que se unen tarde, ver network.Snapshot
+type treeState struct {
+	ReplicaID   uint64
+	LocalTime   uint64
+	Time        [NumReplicas]uint64
+	TruncatedAt uint64
+	Nodes       []stateNode // los hijos en el orden de cada padre
+	History     []LogOperation
+	Ignored     []bool
+	PeerCompact [NumReplicas]bool
+	IDs         [NumReplicas][]uuid.UUID // tablas del codec compacto
+}
+
+type stateNode struct {
+	_msgpack struct{} `msgpack:",omitempty"`
+	ID       uuid.UUID
+	Parent   uuid.UUID
+	Name     string
+	Owners   []uint64
+	Value    []byte
+}
+
+// se llama con el lock tomado
+func (tree *Tree) state() treeState {
+	state := treeState{
+		ReplicaID:   tree.id,
+		LocalTime:   tree.localTime,
+		Time:        tree.time,
+		TruncatedAt: tree.truncatedAt,
+		History:     tree.history,
+		PeerCompact: tree.peerCompact,
+	}
+
+	var walk func(node *treeNode)
+	walk = func(node *treeNode) {
+		for _, child := range node.children {
+			state.Nodes = append(state.Nodes, stateNode{
+				ID:     child.id,
+				Parent: node.id,
+				Name:   child.name,
+				Owners: child.owners,
+				Value:  child.value,
+			})
+			walk(child)
+		}
+	}
+
+	for _, id := range []uuid.UUID{rootID, trashID, nilID} {
+		root := tree.nodes[id]
+		state.Nodes = append(state.Nodes, stateNode{ID: id, Name: root.name, Owners: root.owners})
+		walk(root)
+	}
+
+	for _, op := range tree.history {
+		state.Ignored = append(state.Ignored, op.ignored)
+	}
+
+	for id := range state.IDs {
+		if uint64(id) == tree.id {
+			state.IDs[id] = tree.codec.table()
+		} else {
+			state.IDs[id] = tree.codec.peerIDs[uint64(id)]
+		}
+	}
+
+	return state
+}
+
+// Reemplaza el estado de un arbol que todavia no tiene operaciones
+func (tree *Tree) loadState(state treeState) error {
+	if len(tree.history) > 0 || tree.localTime > 1 {
+		return errors.New("snapshot: the tree already has operations")
+	}
+
+	nodes := make(map[uuid.UUID]*treeNode)
+	names := make(map[string]uuid.UUID)
+	for _, n := range state.Nodes {
+		node := &treeNode{
+			id:     n.ID,
+			name:   n.Name,
+			owners: n.Owners,
+			value:  n.Value,
+		}
+
+		if parent, ok := nodes[n.Parent]; ok && n.ID != n.Parent {
+			node.parent = parent
+			parent.children = append(parent.children, node)
+		} else if n.ID != rootID && n.ID != trashID && n.ID != nilID {
+			return errors.New("snapshot: node without parent")
+		}
+
+		nodes[n.ID] = node
+		names[n.Name] = n.ID
+	}
+
+	if len(state.Ignored) != len(state.History) {
+		return errors.New("snapshot: invalid history")
+	}
+
+	for i := range state.History {
+		state.History[i].ignored = state.Ignored[i]
+	}
+
+	delete(names, "__trash")
+	delete(names, "__nil")
+	tree.nodes = nodes
+	tree.names = names
+	tree.history = state.History
+	tree.localTime = state.LocalTime
+	tree.time = state.Time
+	tree.truncatedAt = state.TruncatedAt
+	tree.peerCompact = state.PeerCompact
+	tree.codec.loadTables(tree.id, state.IDs)
+	return nil
+}
+
+// Responde a un pedido del servidor con el estado del arbol. Se llama
+// con el lock tomado despues de aplicar las operaciones anteriores al
+// pedido, asi el servidor sabe que operaciones incluye
+func (tree *Tree) sendSnapshot() {
+	data, err := msgpack.Marshal(tree.state())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	tree.conn.Send(network.SnapshotMessage(network.Snapshot{
+		Document: tree.doc,
+		Data:     data,
+	}))
+}
+
+// Tiempo minimo entre pedidos del log, los paquetes que siguen a uno
+// invalido suelen fallar tambien
+const SyncInterval = 5 * time.Second
+
+// Se llama con el lock tomado despues de descartar un paquete invalido.
+// El servidor reenvia el log del documento y el arbol descarta las
+// operaciones que ya tiene. Las operaciones que el servidor ya reemplazo
+// por un estado no se recuperan
+func (tree *Tree) requestSync() {
+	if time.Since(tree.syncRequested) < SyncInterval {
+		return
+	}
+
+	tree.syncRequested = time.Now()
+	tree.conn.Send(network.SyncRequestMessage(tree.doc))
+}
+
+// Procesa un pedido de estado o un estado enviado por el servidor. Con
+// firmas no se envian ni se aceptan estados, un estado reemplaza el
+// historial sin firmas ni permisos. El servidor guarda todo el log y las
+// replicas nuevas verifican cada operacion
+func (tree *Tree) receiveSnapshot(data []byte) {
+	var snapshot network.Snapshot
+	if err := msgpack.Unmarshal(data, &snapshot); err != nil {
+		log.Println("invalid snapshot message:", err)
+		return
+	} else if tree.keys != nil {
+		if snapshot.Data != nil {
+			log.Println("rejected snapshot, operations must be signed")
+		}
+
+		return
+	} else if snapshot.Data == nil {
+		tree.sendSnapshot()
+		return
+	}
+
+	var state treeState
+	if err := msgpack.Unmarshal(snapshot.Data, &state); err != nil {
+		log.Println("invalid snapshot:", err)
+	} else if err := tree.loadState(state); err != nil {
+		log.Println(err)
+	} else {
+		tree.publish(Event{Kind: EventReload, Time: tree.localTime - 1})
+	}
+}
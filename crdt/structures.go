@@ -7,6 +7,8 @@
 package crdt
 
 import (
+	"bytes"
+	"io"
 	"log"
 	"time"
 
@@ -14,6 +16,15 @@ import (
 	"github.com/vmihailenco/msgpack/v5"
 )
 
+type OpKind uint8
+
+const (
+	KindMove   OpKind = iota // mover o crear un nodo
+	KindOwners               // cambiar los duenos de un subarbol
+	KindRename               // cambiar el nombre de un nodo
+	KindValue                // cambiar el valor de un nodo, ver TypedTree
+)
+
 type Operation struct {
 	// Para omitir campos en blanco
 	_msgpack struct{} `msgpack:",omitempty"`
@@ -23,6 +34,11 @@ type Operation struct {
 	NewParent uuid.UUID
 	Node      uuid.UUID
 	Name      string
+	Value     []byte // valor de aplicacion, ver TypedTree
+	Document  string // documento del arbol, ver Manager
+	Kind      OpKind
+	Owners    []uint64 // replicas que pueden modificar el subarbol
+	Signature []byte   // firma ed25519 de la replica, ver EnableSigning
 	time      time.Time
 }
 
@@ -39,6 +55,27 @@ func OperationFromBytes(data []byte) Operation {
 	return op
 }
 
+// Decodifica varias operaciones concatenadas
+func OperationsFromBytes(data []byte) []Operation {
+	var ops []Operation
+	dec := msgpack.NewDecoder(bytes.NewReader(data))
+	for {
+		var op Operation
+		err := dec.Decode(&op)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			log.Println("error decoding MessagePack")
+			log.Println(string(data))
+			log.Fatal(err)
+		}
+
+		ops = append(ops, op)
+	}
+
+	return ops
+}
+
 func OperationToBytes(op Operation) []byte {
 	data, err := msgpack.Marshal(op)
 	if err != nil {
@@ -54,6 +91,14 @@ type LogOperation struct {
 	OldParent uuid.UUID
 	NewParent uuid.UUID
 	Node      uuid.UUID
+	Kind      OpKind
+	OldOwners []uint64
+	Owners    []uint64
+	OldName   string
+	Name      string
+	Displaced uuid.UUID // otro nodo con el nombre que se ocupo, ver renameInternal
+	OldValue  []byte
+	Value     []byte
 	ignored   bool
 }
 
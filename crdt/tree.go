@@ -7,6 +7,7 @@
 package crdt
 
 import (
+	"crypto/ed25519"
 	"errors"
 	"fmt"
 	"log"
@@ -34,6 +35,8 @@ type treeNode struct {
 	name     string
 	parent   *treeNode
 	children []*treeNode
+	owners   []uint64 // nil hereda los duenos del padre, ver allowed
+	value    []byte   // valor de aplicacion, ver TypedTree
 }
 
 func (node treeNode) Debug() {
@@ -45,14 +48,16 @@ func (node treeNode) Debug() {
 		fmt.Print(node.parent.id.String())
 	}
 
-	sort.Slice(node.children, func(i, j int) bool {
-		return node.children[i].id.String() < node.children[j].id.String()
+	// se ordena una copia, los lectores comparten el arbol
+	children := append([]*treeNode(nil), node.children...)
+	sort.Slice(children, func(i, j int) bool {
+		return children[i].id.String() < children[j].id.String()
 	})
 
 	fmt.Print(" [")
-	for i, ptr := range node.children {
+	for i, ptr := range children {
 		fmt.Print(ptr.id.String())
-		if i < len(node.children)-1 {
+		if i < len(children)-1 {
 			fmt.Print(" ")
 		}
 	}
@@ -60,15 +65,32 @@ func (node treeNode) Debug() {
 	fmt.Println("]")
 }
 
+// Las lecturas toman el lock de lectura y pueden correr en paralelo,
+// las operaciones locales y remotas toman el lock de escritura
 type Tree struct {
-	sync.Mutex
+	sync.RWMutex
 	id        uint64
+	doc       string // documento, ver Manager
 	localTime uint64 // lamport clock
 	time      [NumReplicas]uint64
 	nodes     map[uuid.UUID]*treeNode
 	names     map[string]uuid.UUID
 	conn      network.ReplicaConn
 	history   []LogOperation
+	origin    *Tree // arbol del que se hizo el fork
+	signKey   ed25519.PrivateKey
+	keys      *KeyRegistry
+	// Codec compacto, ver EnableCompactCodec
+	compact     bool
+	peerCompact [NumReplicas]bool
+	codec       *CompactCodec
+	// Historial truncado, ver AsOf
+	truncatedAt    uint64
+	maxCheckpoints int
+	checkpoints    []checkpoint
+	subscribers    map[chan Event]bool // ver Subscribe
+	connState      network.ConnState
+	syncRequested  time.Time // ultimo pedido del log, ver requestSync
 	// Estadisticas
 	LocalSum    time.Duration
 	LocalCnt    uint64
@@ -79,11 +101,35 @@ type Tree struct {
 }
 
 func NewTree(id int, serverIP string) *Tree {
+	return NewTreeWithConn(id, func(tree network.CRDTTree) network.ReplicaConn {
+		return network.NewCausalConn(tree, serverIP)
+	})
+}
+
+// Crea un arbol con otra conexion, dial recibe el arbol al que se le
+// entregaran las operaciones remotas
+func NewTreeWithConn(id int, dial func(network.CRDTTree) network.ReplicaConn) *Tree {
+	tree := newTree(id, "")
+	// los paquetes que llegan durante dial esperan el lock, asi el arbol
+	// ya tiene la conexion para responder
+	tree.Lock()
+	tree.conn = dial(tree)
+	tree.Unlock()
+	// Esperar a que las demas replicas se inicien
+	time.Sleep(5 * time.Second)
+	tree.startTruncating()
+	return tree
+}
+
+// arbol sin conexion del documento doc
+func newTree(id int, doc string) *Tree {
 	tree := Tree{}
 	tree.id = uint64(id)
+	tree.doc = doc
 	tree.localTime = 1
 	tree.nodes = make(map[uuid.UUID]*treeNode)
 	tree.names = make(map[string]uuid.UUID)
+	tree.codec = NewCompactCodec()
 
 	if NumReplicas < id {
 		panic("Tree CRDT: Invalid ID")
@@ -93,19 +139,16 @@ func NewTree(id int, serverIP string) *Tree {
 	tree.nodes[rootID] = &treeNode{id: rootID, name: rootName}
 	tree.nodes[trashID] = &treeNode{id: trashID, name: "__trash"}
 	tree.nodes[nilID] = &treeNode{id: nilID, name: "__nil"}
+	return &tree
+}
 
-	tree.conn = network.NewCausalConn(&tree, serverIP)
-	// Esperar a que las demas replicas se inicien
-	time.Sleep(5 * time.Second)
-
-	// Iniciando corutina que cada 10 segundos limpiará el historial
+// Iniciando corutina que cada 10 segundos limpiará el historial
+func (tree *Tree) startTruncating() {
 	go func() {
 		for range time.Tick(10 * time.Second) {
 			tree.truncateHistory()
 		}
 	}()
-
-	return &tree
 }
 
 func (tree *Tree) exists(id uuid.UUID) bool {
@@ -168,46 +211,16 @@ func (tree *Tree) moveInternal(id, parentId uuid.UUID) {
 // guardar la nueva op en el historial y reaplicar las ops del historial
 // ignorando las ops invalidas
 func (tree *Tree) apply(op Operation) {
-	undoRedoCnt := uint64(0)
-	// Creación de nodo implícito
-	if !tree.exists(op.Node) {
-		tree.names[op.Name] = op.Node
-		tree.nodes[op.Node] = &treeNode{
-			id:     op.Node,
-			name:   op.Name,
-			parent: tree.nodes[nilID],
-		}
-	}
-	// Creando registro en el historial
-	tree.history = append(tree.history, LogOperation{
-		ReplicaID: op.ReplicaID,
-		Timestamp: op.Timestamp,
-		NewParent: op.NewParent,
-		Node:      op.Node,
-	})
-
-	// Revirtiendo registros con un timestamp mayor
-	i := len(tree.history) - 1
-	for i > 0 && LogOperationBefore(tree.history[i], tree.history[i-1]) {
-		tree.history[i], tree.history[i-1] = tree.history[i-1], tree.history[i]
-		tree.revert(&tree.history[i])
-		i--
-		undoRedoCnt++
-	}
-
-	// Aplicando la operacion y reaplicando operaciones revertidas
-	for i < len(tree.history) {
-		tree.reapply(&tree.history[i])
-		i++
-	}
-
+	undoRedoCnt := tree.applyOps([]Operation{op})
 	if op.ReplicaID == tree.id {
 		// Transmision de actualizacion a otras replicas
 		tree.LocalCnt++
 		tree.LocalSum += time.Since(op.time)
-		data := OperationToBytes(op)
+		op.Document = tree.doc
+		tree.sign(&op)
+		data := tree.encode(op)
 		tree.PacketSzSum += uint64(len(data))
-		tree.conn.Send(data)
+		tree.conn.Send(network.OperationMessage(tree.doc, data))
 	} else {
 		tree.RemoteCnt++
 		tree.RemoteSum += time.Since(op.time)
@@ -218,24 +231,171 @@ func (tree *Tree) apply(op Operation) {
 	tree.localTime = Max(tree.localTime, op.Timestamp) + 1
 }
 
+// aplica varias operaciones remotas revirtiendo el historial una sola
+// vez hasta la mas antigua
+func (tree *Tree) applyRemote(ops []Operation) {
+	sort.Slice(ops, func(i, j int) bool {
+		if ops[i].Timestamp == ops[j].Timestamp {
+			return ops[i].ReplicaID < ops[j].ReplicaID
+		}
+
+		return ops[i].Timestamp < ops[j].Timestamp
+	})
+
+	tree.UndoRedoCnt += tree.applyOps(ops)
+	for _, op := range ops {
+		tree.RemoteCnt++
+		tree.RemoteSum += time.Since(op.time)
+		tree.time[op.ReplicaID] = Max(tree.time[op.ReplicaID], op.Timestamp)
+		tree.localTime = Max(tree.localTime, op.Timestamp) + 1
+	}
+}
+
+// ops debe estar ordenado, devuelve la cantidad de registros revertidos
+func (tree *Tree) applyOps(ops []Operation) uint64 {
+	var logs []LogOperation
+	for _, op := range ops {
+		tree.createNode(op)
+		logs = append(logs, LogOperation{
+			ReplicaID: op.ReplicaID,
+			Timestamp: op.Timestamp,
+			NewParent: op.NewParent,
+			Node:      op.Node,
+			Kind:      op.Kind,
+			Owners:    op.Owners,
+			Name:      op.Name,
+			Value:     op.Value,
+		})
+	}
+
+	// Revirtiendo registros con un timestamp mayor al del primer registro
+	undoRedoCnt := uint64(0)
+	i := len(tree.history)
+	for i > 0 && LogOperationBefore(logs[0], tree.history[i-1]) {
+		i--
+		tree.revert(&tree.history[i])
+		undoRedoCnt++
+	}
+
+	// Intercalando los registros revertidos con los nuevos
+	merged := make([]LogOperation, 0, len(tree.history)-i+len(logs))
+	reverted := tree.history[i:]
+	for len(reverted) > 0 || len(logs) > 0 {
+		if len(logs) == 0 || (len(reverted) > 0 && LogOperationBefore(reverted[0], logs[0])) {
+			merged = append(merged, reverted[0])
+			reverted = reverted[1:]
+		} else {
+			merged = append(merged, logs[0])
+			logs = logs[1:]
+		}
+	}
+
+	// Aplicando las operaciones y reaplicando operaciones revertidas
+	tree.history = append(tree.history[:i], merged...)
+	for i < len(tree.history) {
+		tree.reapply(&tree.history[i])
+		i++
+	}
+
+	tree.notify(ops)
+	return undoRedoCnt
+}
+
+// Creación de nodo implícito
+func (tree *Tree) createNode(op Operation) {
+	if !tree.exists(op.Node) {
+		tree.names[op.Name] = op.Node
+		tree.nodes[op.Node] = &treeNode{
+			id:     op.Node,
+			name:   op.Name,
+			parent: tree.nodes[nilID],
+		}
+	}
+}
+
 // revierte un logmove si no ha sido ignorado
 func (tree *Tree) revert(op *LogOperation) {
 	if op.ignored {
 		return
+	} else if op.Kind == KindOwners {
+		tree.nodes[op.Node].owners = op.OldOwners
+		return
+	} else if op.Kind == KindRename {
+		op.Displaced = tree.renameInternal(op.Node, op.OldName, op.Displaced)
+		return
+	} else if op.Value != nil {
+		tree.nodes[op.Node].value = op.OldValue
+	}
+
+	if op.Kind == KindMove {
+		tree.moveInternal(op.Node, op.OldParent)
+	}
+}
+
+// cambiar el nombre y el indice de nombres. Al revertir y reaplicar un
+// nombre puede estar ocupado por otro nodo, el nombre que se deja vuelve
+// a displaced y se devuelve el nodo que tenia el nuevo nombre
+func (tree *Tree) renameInternal(id uuid.UUID, name string, displaced uuid.UUID) uuid.UUID {
+	node := tree.nodes[id]
+	if tree.names[node.name] == id {
+		delete(tree.names, node.name)
+		if other, ok := tree.nodes[displaced]; ok && displaced != id && other.name == node.name {
+			tree.names[node.name] = displaced
+		}
 	}
 
-	tree.moveInternal(op.Node, op.OldParent)
+	previous, ok := tree.names[name]
+	node.name = name
+	tree.names[name] = id
+	if !ok || previous == id {
+		return nilID
+	}
+
+	return previous
 }
 
 // reaplica un logmove o lo ignora
 func (tree *Tree) reapply(op *LogOperation) {
-	op.ignored = !tree.exists(op.NewParent) || tree.descendant(op.NewParent, op.Node)
+	if op.Kind == KindOwners {
+		op.ignored = !tree.allowed(op.ReplicaID, op.Node)
+		if !op.ignored {
+			op.OldOwners = tree.nodes[op.Node].owners
+			tree.nodes[op.Node].owners = op.Owners
+		}
+
+		return
+	} else if op.Kind == KindRename {
+		op.ignored = !tree.allowed(op.ReplicaID, op.Node)
+		if !op.ignored {
+			op.OldName = tree.nodes[op.Node].name
+			op.Displaced = tree.renameInternal(op.Node, op.Name, op.Displaced)
+		}
+
+		return
+	} else if op.Kind == KindValue {
+		// el historial esta ordenado, el ultimo valor aplicado gana
+		op.ignored = !tree.allowed(op.ReplicaID, op.Node)
+		if !op.ignored {
+			op.OldValue = tree.nodes[op.Node].value
+			tree.nodes[op.Node].value = op.Value
+		}
+
+		return
+	}
+
+	// las operaciones no autorizadas se ignoran igual en todas las replicas
+	op.ignored = !tree.exists(op.NewParent) || tree.descendant(op.NewParent, op.Node) ||
+		!tree.allowed(op.ReplicaID, op.Node) || !tree.allowed(op.ReplicaID, op.NewParent)
 	if op.ignored {
 		return
 	}
 
 	op.OldParent = tree.nodes[op.Node].parent.id
 	tree.moveInternal(op.Node, op.NewParent)
+	if op.Value != nil {
+		op.OldValue = tree.nodes[op.Node].value
+		tree.nodes[op.Node].value = op.Value
+	}
 }
 
 func (tree *Tree) truncateHistory() {
@@ -248,7 +408,17 @@ func (tree *Tree) truncateHistory() {
 	}
 
 	start := HistoryUpperBound(tree.history, time)
+	if start == 0 {
+		return
+	}
+
+	truncated := tree.history[:start]
+	from := tree.truncatedAt
 	tree.history = tree.history[start:]
+	tree.truncatedAt = time
+	if tree.maxCheckpoints > 0 {
+		tree.saveCheckpoint(from, time, truncated)
+	}
 }
 
 func (tree *Tree) GetID() int {
@@ -256,16 +426,94 @@ func (tree *Tree) GetID() int {
 }
 
 func (tree *Tree) ApplyRemoteOperation(data []byte) {
+	tree.ApplyRemoteOperations([][]byte{data})
+}
+
+// Aplica todos los paquetes juntos, ver applyRemote
+func (tree *Tree) ApplyRemoteOperations(packets [][]byte) {
 	tree.Lock()
 	defer tree.Unlock()
 
-	tree.PacketSzSum += uint64(len(data))
-	op := OperationFromBytes(data)
-	op.time = time.Now()
-	tree.apply(op)
+	var ops []Operation
+	// operaciones del lote, las del historial se buscan con applied
+	seen := make(map[[2]uint64]bool)
+	for _, data := range packets {
+		tree.PacketSzSum += uint64(len(data))
+		env, err := network.ReadEnvelope(data)
+		switch {
+		case err != nil:
+			// se descarta abajo como un paquete invalido
+		case env.Type == network.TypeSnapshot || env.Type == network.TypeSyncRequest:
+			// el estado debe incluir justo las operaciones anteriores
+			if len(ops) > 0 {
+				tree.applyRemote(ops)
+				ops = nil
+			}
+
+			tree.receiveSnapshot(env.Payload)
+			continue
+		case env.Type == network.TypeCapabilities:
+			tree.receiveCapabilities(env.Payload)
+			continue
+		case env.Type != network.TypeOperation:
+			continue
+		}
+
+		// un paquete puede traer varias operaciones, ver applyLocalBatch
+		var decoded []Operation
+		if err == nil {
+			decoded, err = tree.decode(env.Payload)
+		}
+
+		if err != nil {
+			log.Println("dropping invalid packet:", err)
+			tree.requestSync()
+			continue
+		}
+
+		for _, op := range decoded {
+			key := [2]uint64{op.ReplicaID, op.Timestamp}
+			if seen[key] || tree.applied(op) {
+				continue
+			} else if !tree.verify(op) {
+				log.Println("rejected operation with invalid signature from replica", op.ReplicaID)
+				continue
+			}
+
+			seen[key] = true
+			op.time = time.Now()
+			ops = append(ops, op)
+		}
+	}
+
+	if len(ops) > 0 {
+		tree.applyRemote(ops)
+	}
+}
+
+// Una operacion que ya esta en el historial, o que es anterior al
+// historial truncado, es un duplicado de una reconexion o de un log
+// reenviado, ver requestSync
+func (tree *Tree) applied(op Operation) bool {
+	if op.Timestamp <= tree.truncatedAt {
+		return true
+	}
+
+	for i := HistoryUpperBound(tree.history, op.Timestamp) - 1; i >= 0 && tree.history[i].Timestamp == op.Timestamp; i-- {
+		if tree.history[i].ReplicaID == op.ReplicaID {
+			return true
+		}
+	}
+
+	return false
 }
 
 func (tree *Tree) Add(name, parent string) error {
+	return tree.AddWithValue(name, parent, nil)
+}
+
+// Agrega un nodo con un valor de aplicacion, ver TypedTree
+func (tree *Tree) AddWithValue(name, parent string, value []byte) error {
 	tree.Lock()
 	defer tree.Unlock()
 
@@ -276,6 +524,8 @@ func (tree *Tree) Add(name, parent string) error {
 	parentID, ok := tree.names[parent]
 	if !ok /* || tree.deleted(parentID) */ {
 		return errors.New("add: parent does not exist")
+	} else if !tree.allowed(tree.id, parentID) {
+		return errors.New("add: permission denied")
 	}
 
 	op := Operation{
@@ -284,6 +534,7 @@ func (tree *Tree) Add(name, parent string) error {
 		NewParent: parentID,
 		Node:      uuid.New(),
 		Name:      name,
+		Value:     value,
 		time:      time.Now(),
 	}
 	tree.apply(op)
@@ -306,6 +557,8 @@ func (tree *Tree) Move(node, newParent string) error {
 		return errors.New("move: cannot move node to one of its decendants")
 	} else if parentID == tree.nodes[nodeID].parent.id {
 		return errors.New("move: new parent is already the parent of node")
+	} else if !tree.allowed(tree.id, nodeID) || !tree.allowed(tree.id, parentID) {
+		return errors.New("move: permission denied")
 	}
 
 	op := Operation{
@@ -329,6 +582,8 @@ func (tree *Tree) Remove(node string) error {
 		return errors.New("remove: node does not exist")
 	} else if nodeID == rootID {
 		return errors.New("remove: cannot remove root")
+	} else if !tree.allowed(tree.id, nodeID) {
+		return errors.New("remove: permission denied")
 	}
 
 	op := Operation{
@@ -342,11 +597,49 @@ func (tree *Tree) Remove(node string) error {
 	return nil
 }
 
-// imprimir tree.nodes de forma ordenada
-func (tree *Tree) Debug() {
+// Cambia el nombre de un nodo sin cambiar su identidad
+func (tree *Tree) Rename(node, name string) error {
 	tree.Lock()
 	defer tree.Unlock()
 
+	nodeID, ok := tree.names[node]
+	if !ok {
+		return errors.New("rename: node does not exist")
+	} else if _, ok := tree.names[name]; ok {
+		return errors.New("rename: name already exists")
+	} else if nodeID == rootID {
+		return errors.New("rename: cannot rename root")
+	} else if !tree.allowed(tree.id, nodeID) {
+		return errors.New("rename: permission denied")
+	}
+
+	op := Operation{
+		ReplicaID: tree.id,
+		Timestamp: tree.localTime,
+		NewParent: nilID,
+		Node:      nodeID,
+		Name:      name,
+		Kind:      KindRename,
+		time:      time.Now(),
+	}
+	tree.apply(op)
+	return nil
+}
+
+// Si el nodo esta en la papelera
+func (tree *Tree) InTrash(node string) bool {
+	tree.RLock()
+	defer tree.RUnlock()
+
+	id, ok := tree.names[node]
+	return ok && tree.deleted(id)
+}
+
+// imprimir tree.nodes de forma ordenada
+func (tree *Tree) Debug() {
+	tree.RLock()
+	defer tree.RUnlock()
+
 	fmt.Println(tree.RemoteCnt+tree.LocalCnt, "operations")
 	var keys []uuid.UUID
 	for k := range tree.nodes {
@@ -364,20 +657,17 @@ func (tree *Tree) Debug() {
 
 // imprimir arbol de forma bonita
 func (tree *Tree) Print() {
-	tree.Lock()
-	defer tree.Unlock()
+	tree.RLock()
+	defer tree.RUnlock()
 
 	fmt.Println(rootName)
 	printInternal(tree.nodes[rootID], "")
 }
 
 func printInternal(node *treeNode, prefix string) {
-	sort.Slice(node.children, func(i, j int) bool {
-		return node.children[i].name < node.children[j].name
-	})
-
-	for index, child := range node.children {
-		if index == len(node.children)-1 {
+	children := sortedChildren(node)
+	for index, child := range children {
+		if index == len(children)-1 {
 			fmt.Println(prefix+"└──", child.name)
 			printInternal(child, prefix+"    ")
 		} else {
@@ -399,9 +689,52 @@ func (tree *Tree) Close() {
 	tree.conn.Close()
 }
 
+// Estadisticas de la replica, Nodes no cuenta la papelera
+type Stats struct {
+	ReplicaID      int           `json:"replica_id"`
+	Time           uint64        `json:"time"`
+	Nodes          int           `json:"nodes"`
+	History        int           `json:"history"`
+	LocalOps       uint64        `json:"local_ops"`
+	RemoteOps      uint64        `json:"remote_ops"`
+	AvgLocalDelay  time.Duration `json:"avg_local_delay_ns"`
+	AvgRemoteDelay time.Duration `json:"avg_remote_delay_ns"`
+	AvgUndoRedo    float64       `json:"avg_undo_redo"`
+	AvgPacketSize  float64       `json:"avg_packet_size"`
+}
+
+func (tree *Tree) Stats() Stats {
+	tree.RLock()
+	defer tree.RUnlock()
+
+	stats := Stats{
+		ReplicaID: int(tree.id),
+		Time:      tree.localTime - 1,
+		Nodes:     len(getNamesInternal(tree.nodes[rootID], nil)),
+		History:   len(tree.history),
+		LocalOps:  tree.LocalCnt,
+		RemoteOps: tree.RemoteCnt,
+	}
+
+	if tree.LocalCnt > 0 {
+		stats.AvgLocalDelay = tree.LocalSum / time.Duration(tree.LocalCnt)
+	}
+
+	if tree.RemoteCnt > 0 {
+		stats.AvgRemoteDelay = tree.RemoteSum / time.Duration(tree.RemoteCnt)
+		stats.AvgUndoRedo = float64(tree.UndoRedoCnt) / float64(tree.RemoteCnt)
+	}
+
+	if n := tree.LocalCnt + tree.RemoteCnt; n > 0 {
+		stats.AvgPacketSize = float64(tree.PacketSzSum) / float64(n)
+	}
+
+	return stats
+}
+
 func (tree *Tree) GetNames() []string {
-	tree.Lock()
-	defer tree.Unlock()
+	tree.RLock()
+	defer tree.RUnlock()
 
 	return getNamesInternal(tree.nodes[rootID], []string{})
 }
@@ -414,3 +747,27 @@ func getNamesInternal(node *treeNode, names []string) []string {
 
 	return names
 }
+
+// Caminos relativos (separados por /) de los descendientes de name con
+// el ID de cada nodo, usado para reflejar el arbol en un directorio
+func (tree *Tree) Paths(name string) (map[string]uuid.UUID, error) {
+	tree.RLock()
+	defer tree.RUnlock()
+
+	id, ok := tree.names[name]
+	if !ok {
+		return nil, errors.New("paths: node does not exist")
+	}
+
+	paths := make(map[string]uuid.UUID)
+	var walk func(node *treeNode, prefix string)
+	walk = func(node *treeNode, prefix string) {
+		for _, child := range node.children {
+			paths[prefix+child.name] = child.id
+			walk(child, prefix+child.name+"/")
+		}
+	}
+
+	walk(tree.nodes[id], "")
+	return paths, nil
+}
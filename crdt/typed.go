@@ -0,0 +1,101 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package crdt
+
+import (
+	"errors"
+	"time"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Arbol cuyos nodos llevan un valor de tipo T. El valor se serializa con
+// MessagePack dentro de Operation y se replica con last writer wins: los
+// cambios de valor van al historial y gana el ultimo en orden de
+// LogOperationBefore, asi AsOf y Diff tambien ven los valores
+type TypedTree[T any] struct {
+	*Tree
+}
+
+func NewTypedTree[T any](id int, serverIP string) *TypedTree[T] {
+	return &TypedTree[T]{NewTree(id, serverIP)}
+}
+
+// Usa un arbol existente con valores de tipo T
+func Typed[T any](tree *Tree) *TypedTree[T] {
+	return &TypedTree[T]{tree}
+}
+
+func (tree *TypedTree[T]) Add(name, parent string, value T) error {
+	data, err := msgpack.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	return tree.AddWithValue(name, parent, data)
+}
+
+func (tree *TypedTree[T]) Set(name string, value T) error {
+	data, err := msgpack.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	return tree.SetValue(name, data)
+}
+
+// Si el nodo nunca tuvo valor se devuelve el valor cero de T
+func (tree *TypedTree[T]) Get(name string) (T, error) {
+	var value T
+	data, err := tree.Value(name)
+	if err != nil || data == nil {
+		return value, err
+	}
+
+	err = msgpack.Unmarshal(data, &value)
+	return value, err
+}
+
+// Cambia el valor de un nodo sin moverlo
+func (tree *Tree) SetValue(name string, value []byte) error {
+	tree.Lock()
+	defer tree.Unlock()
+
+	nodeID, ok := tree.names[name]
+	if !ok {
+		return errors.New("set: node does not exist")
+	} else if len(value) == 0 {
+		// un valor vacio se omite al serializar la operacion
+		return errors.New("set: empty value")
+	} else if !tree.allowed(tree.id, nodeID) {
+		return errors.New("set: permission denied")
+	}
+
+	op := Operation{
+		ReplicaID: tree.id,
+		Timestamp: tree.localTime,
+		NewParent: nilID,
+		Node:      nodeID,
+		Value:     value,
+		Kind:      KindValue,
+		time:      time.Now(),
+	}
+	tree.apply(op)
+	return nil
+}
+
+func (tree *Tree) Value(name string) ([]byte, error) {
+	tree.RLock()
+	defer tree.RUnlock()
+
+	nodeID, ok := tree.names[name]
+	if !ok {
+		return nil, errors.New("get: node does not exist")
+	}
+
+	return tree.nodes[nodeID].value, nil
+}
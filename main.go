@@ -9,13 +9,17 @@ package main
 import (
 	"bufio"
 	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"os"
 	"strconv"
 	"strings"
 	"time"
+	"udr-tree/api"
 	"udr-tree/crdt"
+	"udr-tree/mirror"
+	"udr-tree/network"
 )
 
 var (
@@ -28,22 +32,95 @@ func main() {
   add [name] [parent]	Add new node [name] to be child of [parent]
   rm [node]		Remove [node]
   mv [node] [parent]	Operation [node] to be child of [parent]
-  print			Show tree
+  owners [node] [ids]	Only replicas [ids] can change the subtree of [node],
+			without [ids] the owners are inherited from the parent
+  print [time]		Show tree, optionally as it was at Lamport [time]
+  time			Show current Lamport time
+  diff [t1] [t2] [json]	Show changes between Lamport times [t1] and [t2]
+  export [fmt] [file]	Write tree to [file] as json, dot, yaml or csv,
+			add 'trash' and 'ids' to include the trash and node IDs
+  import [fmt] [path] [parent]
+			Import a json or csv file, or a directory with
+			fmt 'dir', as children of [parent]
+  mirror [dir] [node]	Keep folders of [dir] in sync with children of [node]
+  keygen [file]		Write a new private key and show its public key
+  keys [key] [registry]	Sign operations with private [key] file and only
+			accept operations signed with keys in [registry]
   connect		Connect to other replicas
   disconnect		Disconnect from other replicas
+  fork			Work on a private copy of the tree
+  merge			Publish the operations of the fork
+  discard		Discard the fork
   quit			Close app
   help			Show this message`
 
-	if len(os.Args) != 3 {
-		log.Fatal(errors.New("USE: ./udr-tree [id] [server_ip]"))
+	keyring := flag.String("keyring", "", "encrypt operations with the keys in this file")
+	batch := flag.Bool("batch", false, "send operations in batches")
+	batchDelay := flag.Duration("batch-delay", 0, "max time an operation waits in a batch")
+	compress := flag.Bool("compress", false, "compress batches")
+	compact := flag.Bool("compact", false, "use the compact codec with the replicas that support it")
+	peers := flag.String("peers", "", "connect directly to these comma separated replicas, [server_ip] is the address to listen on")
+	gossip := flag.Bool("gossip", false, "with -peers, exchange operations with random peers instead of sending them to all")
+	fanout := flag.Int("fanout", network.DefaultGossipConfig.Fanout, "peers contacted in each gossip round")
+	gossipInterval := flag.Duration("gossip-interval", network.DefaultGossipConfig.Interval, "time between gossip rounds")
+	httpAddr := flag.String("http", "", "serve the JSON API on this address")
+	flag.Parse()
+	if flag.NArg() != 2 {
+		log.Fatal(errors.New("USE: ./udr-tree [flags] [id] [server_ip]"))
 	}
 
-	id, err := strconv.Atoi(os.Args[1])
+	id, err := strconv.Atoi(flag.Arg(0))
 	if err != nil {
 		panic(err)
 	}
 
-	tree := crdt.NewTree(id, os.Args[2])
+	dial := func(tree network.CRDTTree) network.ReplicaConn {
+		if *peers != "" && *gossip {
+			return network.NewGossipConn(tree, flag.Arg(1), strings.Split(*peers, ","), network.GossipConfig{
+				Fanout:   *fanout,
+				Interval: *gossipInterval,
+			})
+		} else if *peers != "" {
+			return network.NewMeshConn(tree, flag.Arg(1), strings.Split(*peers, ","))
+		}
+
+		conn := network.NewCausalConn(tree, flag.Arg(1))
+		conn.SetBatching(network.BatchConfig{
+			Enabled:  *batch,
+			MaxBytes: 64 * 1024,
+			MaxDelay: *batchDelay,
+			Compress: *compress,
+		})
+		return conn
+	}
+
+	if *keyring != "" {
+		ring, err := network.LoadKeyRing(*keyring)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		causalDial := dial
+		dial = func(tree network.CRDTTree) network.ReplicaConn {
+			return network.NewSealedConn(tree, ring, causalDial)
+		}
+	}
+
+	base := crdt.NewTreeWithConn(id, dial)
+	base.EnableCheckpoints(10)
+	if *compact {
+		base.EnableCompactCodec()
+	}
+
+	if *httpAddr != "" {
+		go func() {
+			log.Fatal(api.New(base).ListenAndServe(*httpAddr))
+		}()
+	}
+
+	// los comandos se aplican al fork si existe
+	tree := base
+	var m *mirror.Mirror
 	time.Sleep(5 * time.Second)
 	fmt.Print("> ")
 	// para leer linea por linea
@@ -77,14 +154,124 @@ func main() {
 			} else {
 				err = errInvalid
 			}
+		case "owners":
+			if len(cmd) >= 2 {
+				var owners []uint64
+				for _, arg := range cmd[2:] {
+					var owner uint64
+					if owner, err = strconv.ParseUint(arg, 10, 64); err != nil {
+						break
+					}
+
+					owners = append(owners, owner)
+				}
+
+				if err == nil {
+					err = tree.SetOwners(cmd[1], owners)
+				}
+			} else {
+				err = errInvalid
+			}
 		case "print":
-			tree.Print()
+			if len(cmd) >= 2 {
+				var t uint64
+				var view *crdt.View
+				if t, err = strconv.ParseUint(cmd[1], 10, 64); err == nil {
+					if view, err = tree.AsOf(t); err == nil {
+						view.Print()
+					}
+				}
+			} else {
+				tree.Print()
+			}
+		case "diff":
+			if len(cmd) >= 3 {
+				var t1, t2 uint64
+				var changes []crdt.Change
+				t1, err = strconv.ParseUint(cmd[1], 10, 64)
+				if err == nil {
+					t2, err = strconv.ParseUint(cmd[2], 10, 64)
+				}
+
+				if err == nil {
+					changes, err = tree.Diff(t1, t2)
+				}
+
+				if err == nil && len(cmd) >= 4 && cmd[3] == "json" {
+					err = crdt.WriteDiffJSON(os.Stdout, changes)
+				} else if err == nil {
+					err = crdt.WriteDiffText(os.Stdout, changes)
+				}
+			} else {
+				err = errInvalid
+			}
+		case "time":
+			fmt.Println(tree.Time())
+		case "export":
+			if len(cmd) >= 3 {
+				err = export(tree, cmd[1], cmd[2], cmd[3:])
+			} else {
+				err = errInvalid
+			}
+		case "import":
+			if len(cmd) >= 4 {
+				var n int
+				n, err = importTree(tree, cmd[1], cmd[2], cmd[3])
+				fmt.Println(n, "nodes imported")
+			} else {
+				err = errInvalid
+			}
+		case "mirror":
+			if len(cmd) >= 3 && m == nil {
+				m = mirror.New(base, cmd[1], cmd[2], time.Second)
+				m.Start()
+			} else {
+				err = errInvalid
+			}
+		case "keygen":
+			if len(cmd) >= 2 {
+				var public string
+				if public, err = crdt.GeneratePrivateKey(cmd[1]); err == nil {
+					fmt.Println(base.GetID(), public)
+				}
+			} else {
+				err = errInvalid
+			}
+		case "keys":
+			if len(cmd) >= 3 {
+				err = enableSigning(base, cmd[1], cmd[2])
+			} else {
+				err = errInvalid
+			}
 		case "connect":
 			tree.Connect()
 		case "disconnect":
 			tree.Disconnect()
+		case "fork":
+			if tree != base {
+				err = errors.New("fork: already working on a fork")
+			} else {
+				tree = base.Fork()
+			}
+		case "merge":
+			if tree == base {
+				err = errors.New("merge: not working on a fork")
+			} else {
+				var conflicts []crdt.Conflict
+				conflicts, err = base.MergeFork(tree)
+				for _, c := range conflicts {
+					fmt.Println("conflict:", c.Op.Node, c.Reason)
+				}
+				tree = base
+			}
+		case "discard":
+			tree = base
 		case "quit":
-			tree.Close()
+			if m != nil {
+				m.Stop()
+			}
+
+			base.Close()
 			return
 		case "help":
 			fmt.Println(helpMessage)
@@ -99,3 +286,64 @@ func main() {
 		fmt.Print("> ")
 	}
 }
+
+func export(tree *crdt.Tree, name, path string, flags []string) error {
+	format, err := crdt.ParseFormat(name)
+	if err != nil {
+		return err
+	}
+
+	var opts crdt.ExportOptions
+	for _, flag := range flags {
+		switch flag {
+		case "trash":
+			opts.Trash = true
+		case "ids":
+			opts.IDs = true
+		default:
+			return errInvalid
+		}
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+	return tree.Export(file, format, opts)
+}
+
+func importTree(tree *crdt.Tree, name, path, parent string) (int, error) {
+	if name == "dir" {
+		return tree.ImportDir(path, parent)
+	}
+
+	format, err := crdt.ParseFormat(name)
+	if err != nil {
+		return 0, err
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+
+	defer file.Close()
+	return tree.Import(file, format, parent)
+}
+
+func enableSigning(tree *crdt.Tree, keyPath, registryPath string) error {
+	key, err := crdt.LoadPrivateKey(keyPath)
+	if err != nil {
+		return err
+	}
+
+	registry, err := crdt.LoadKeyRegistry(registryPath)
+	if err != nil {
+		return err
+	}
+
+	tree.EnableSigning(key, registry)
+	return nil
+}
@@ -0,0 +1,409 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package mirror
+
+import (
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"udr-tree/crdt"
+
+	"github.com/google/uuid"
+)
+
+// Refleja las carpetas de un directorio en un nodo del arbol y viceversa.
+// Los nombres de los nodos son los nombres de las carpetas, asi que dos
+// carpetas con el mismo nombre no se pueden reflejar y se ignoran.
+//
+// Regla de conflictos: los cambios locales ganan. En cada pasada primero
+// se aplican al arbol los cambios del directorio y despues se materializa
+// el arbol. Una carpeta borrada remotamente que todavia tiene archivos se
+// restaura en el arbol en vez de borrarse. Una carpeta local que no se
+// pudo agregar al arbol, por ejemplo porque su nombre ya existe fuera del
+// directorio, se deja como esta con todo su contenido
+type Mirror struct {
+	tree     *crdt.Tree
+	dir      string
+	node     string
+	interval time.Duration
+	known    map[string]os.FileInfo // ultimo escaneo, caminos relativos con /
+	paths    map[uuid.UUID]string   // camino de cada nodo en la ultima pasada
+	ignored  map[string]bool        // nombres duplicados ya reportados
+	failed   map[string]bool        // carpetas locales que no estan en el arbol
+	exit     chan bool
+	wg       sync.WaitGroup
+}
+
+// cambio local, from vacio es una carpeta nueva
+type change struct {
+	from string
+	to   string
+}
+
+func New(tree *crdt.Tree, dir, node string, interval time.Duration) *Mirror {
+	return &Mirror{
+		tree:     tree,
+		dir:      dir,
+		node:     node,
+		interval: interval,
+		known:    make(map[string]os.FileInfo),
+		paths:    make(map[uuid.UUID]string),
+		ignored:  make(map[string]bool),
+		failed:   make(map[string]bool),
+		exit:     make(chan bool),
+	}
+}
+
+func (m *Mirror) Start() {
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		ticker := time.NewTicker(m.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := m.Poll(); err != nil {
+					log.Println("mirror:", err)
+				}
+			case <-m.exit:
+				return
+			}
+		}
+	}()
+}
+
+// no bloquea si no se llamo a Start
+func (m *Mirror) Stop() {
+	close(m.exit)
+	m.wg.Wait()
+}
+
+// Una pasada de sincronizacion en ambos sentidos
+func (m *Mirror) Poll() error {
+	scan, err := m.scan()
+	if err != nil {
+		return err
+	}
+
+	dups := duplicates(scan)
+	for name := range dups {
+		if !m.ignored[name] {
+			m.ignored[name] = true
+			log.Println("mirror: ignoring duplicated folder name", name)
+		}
+	}
+
+	m.pushLocal(scan, dups)
+	// las carpetas que ya no estan se olvidan
+	for rel := range m.failed {
+		if _, ok := scan[rel]; !ok {
+			delete(m.failed, rel)
+		}
+	}
+
+	if scan, err = m.scan(); err != nil {
+		return err
+	}
+
+	if err = m.materialize(scan, dups); err != nil {
+		return err
+	}
+
+	m.known, err = m.scan()
+	return err
+}
+
+func (m *Mirror) scan() (map[string]os.FileInfo, error) {
+	dirs := make(map[string]os.FileInfo)
+	err := filepath.WalkDir(m.dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		} else if !d.IsDir() || p == m.dir {
+			return nil
+		}
+
+		rel, err := filepath.Rel(m.dir, p)
+		if err != nil {
+			return err
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		dirs[filepath.ToSlash(rel)] = info
+		return nil
+	})
+
+	return dirs, err
+}
+
+func duplicates(scan map[string]os.FileInfo) map[string]bool {
+	count := make(map[string]int)
+	for rel := range scan {
+		count[path.Base(rel)]++
+	}
+
+	dups := make(map[string]bool)
+	for name, n := range count {
+		if n > 1 {
+			dups[name] = true
+		}
+	}
+
+	return dups
+}
+
+// nombre del nodo padre de una carpeta
+func (m *Mirror) parentName(rel string) string {
+	if dir := path.Dir(rel); dir != "." {
+		return path.Base(dir)
+	}
+
+	return m.node
+}
+
+func depth(rel string) int {
+	return strings.Count(rel, "/")
+}
+
+// ordena caminos de forma que los padres van antes que los hijos
+func sortByDepth(paths []string) {
+	sort.Slice(paths, func(i, j int) bool {
+		if depth(paths[i]) != depth(paths[j]) {
+			return depth(paths[i]) < depth(paths[j])
+		}
+
+		return paths[i] < paths[j]
+	})
+}
+
+// convierte las diferencias con el escaneo anterior en operaciones
+func (m *Mirror) pushLocal(scan map[string]os.FileInfo, dups map[string]bool) {
+	matched := make(map[string]bool)
+	for rel := range scan {
+		if _, ok := m.known[rel]; ok {
+			matched[rel] = true
+		}
+	}
+
+	// las carpetas movidas o renombradas se reconocen por el inodo
+	changes := make(map[string]change)
+	var targets []string
+	for rel, info := range scan {
+		if matched[rel] {
+			continue
+		}
+
+		// una carpeta que no esta en el arbol movida sigue siendo nueva
+		c := change{to: rel}
+		for oldRel, old := range m.known {
+			if _, ok := scan[oldRel]; !ok && !matched[oldRel] && os.SameFile(old, info) {
+				matched[oldRel] = true
+				if !m.failed[oldRel] {
+					c.from = oldRel
+				}
+				break
+			}
+		}
+
+		changes[rel] = c
+		targets = append(targets, rel)
+	}
+
+	sortByDepth(targets)
+	var removed []string
+	for _, rel := range targets {
+		c := changes[rel]
+		name := path.Base(rel)
+		if dups[name] {
+			continue
+		} else if c.from == "" {
+			// con el padre fuera del arbol el nombre del padre puede ser
+			// de otro nodo
+			if m.failed[path.Dir(rel)] || m.add(name, m.parentName(rel)) != nil {
+				m.failed[rel] = true
+			}
+			continue
+		}
+
+		// el nodo conserva su identidad al renombrar la carpeta
+		if oldName := path.Base(c.from); oldName != name {
+			if err := m.tree.Rename(oldName, name); err != nil {
+				m.logError(err)
+				continue
+			}
+		}
+
+		if m.parentName(c.from) != m.parentName(rel) {
+			m.logError(m.tree.Move(name, m.parentName(rel)))
+		}
+	}
+
+	// solo se borra la carpeta mas alta, los hijos se van con ella
+	for oldRel := range m.known {
+		_, parentGone := m.known[path.Dir(oldRel)]
+		parentGone = parentGone && !matched[path.Dir(oldRel)]
+		if !matched[oldRel] && !parentGone && !dups[path.Base(oldRel)] && !m.failed[oldRel] {
+			removed = append(removed, path.Base(oldRel))
+		}
+	}
+
+	for _, name := range removed {
+		m.logError(m.tree.Remove(name))
+	}
+}
+
+// si el nombre ya existe en la papelera el nodo se mueve a parent, asi
+// se restauran los nodos borrados
+func (m *Mirror) add(name, parent string) error {
+	var err error
+	if m.tree.InTrash(name) {
+		err = m.tree.Move(name, parent)
+	} else {
+		err = m.tree.Add(name, parent)
+	}
+
+	m.logError(err)
+	return err
+}
+
+func (m *Mirror) logError(err error) {
+	if err != nil {
+		log.Println("mirror:", err)
+	}
+}
+
+func (m *Mirror) abs(rel string) string {
+	return filepath.Join(m.dir, filepath.FromSlash(rel))
+}
+
+// aplica el estado del arbol al directorio
+func (m *Mirror) materialize(scan map[string]os.FileInfo, dups map[string]bool) error {
+	treePaths, err := m.tree.Paths(m.node)
+	if err != nil {
+		return err
+	}
+
+	local := make(map[string]string)
+	for rel := range scan {
+		if !m.failed[rel] {
+			local[path.Base(rel)] = rel
+		}
+	}
+
+	var targets []string
+	for p := range treePaths {
+		targets = append(targets, p)
+	}
+
+	sortByDepth(targets)
+	inTree := make(map[string]bool)
+	for _, target := range targets {
+		name := path.Base(target)
+		inTree[name] = true
+		rel, ok := local[name]
+		// un nodo renombrado en otra replica se busca por su camino anterior
+		if prev, found := m.paths[treePaths[target]]; !ok && found && local[path.Base(prev)] == prev {
+			rel, ok = prev, true
+			delete(local, path.Base(prev))
+		}
+
+		if dups[name] || (ok && rel == target) {
+			continue
+		} else if _, err := os.Stat(m.abs(target)); err == nil {
+			continue
+		}
+
+		if !ok {
+			if err := os.Mkdir(m.abs(target), 0755); err != nil {
+				log.Println("mirror:", err)
+			} else {
+				local[name] = target
+			}
+
+			continue
+		}
+
+		if err := os.Rename(m.abs(rel), m.abs(target)); err != nil {
+			log.Println("mirror:", err)
+			continue
+		}
+
+		// los hijos de la carpeta movida cambian de camino
+		for childName, childRel := range local {
+			if strings.HasPrefix(childRel, rel+"/") {
+				local[childName] = target + childRel[len(rel):]
+			}
+		}
+
+		local[name] = target
+	}
+
+	// carpetas que ya no estan en el arbol
+	var gone []string
+	for name, rel := range local {
+		if !inTree[name] && !dups[name] {
+			gone = append(gone, rel)
+		}
+	}
+
+	sortByDepth(gone)
+	var handled []string
+	for _, rel := range gone {
+		if under(rel, handled) {
+			continue
+		}
+
+		// restaurar el padre tambien restaura a los hijos
+		handled = append(handled, rel)
+		if hasFiles(m.abs(rel)) {
+			m.add(path.Base(rel), m.parentName(rel))
+		} else if err := os.RemoveAll(m.abs(rel)); err != nil {
+			log.Println("mirror:", err)
+		}
+	}
+
+	m.paths = make(map[uuid.UUID]string)
+	for target, id := range treePaths {
+		m.paths[id] = target
+	}
+
+	return nil
+}
+
+func under(rel string, dirs []string) bool {
+	for _, dir := range dirs {
+		if strings.HasPrefix(rel, dir+"/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+func hasFiles(dir string) bool {
+	found := false
+	filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			found = true
+			return fs.SkipAll
+		}
+
+		return nil
+	})
+
+	return found
+}
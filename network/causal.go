@@ -7,42 +7,125 @@
 package network
 
 import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"log"
+	"math/rand"
 	"net"
+	"slices"
 	"sync"
+	"sync/atomic"
+	"time"
 
-	// "log"
 	"github.com/vmihailenco/msgpack/v5"
 )
 
+// Cada cuanto se confirman los mensajes recibidos
+const AckInterval = time.Second
+
+// Tiempo maximo para el handshake con el servidor
+const HandshakeTimeout = 10 * time.Second
+
+// Mensajes guardados para reenviar despues de una reconexion, si se
+// superan se descartan los mas viejos
+const MaxUnconfirmed = 100000
+
+// Espera entre reintentos de conexion, se duplica en cada intento hasta
+// ReconnectMaxDelay y se le suma un azar de hasta la mitad
+var (
+	ReconnectMinDelay = 100 * time.Millisecond
+	ReconnectMaxDelay = 30 * time.Second
+)
+
+// Conexion con el servidor que sobrevive a las caidas: si se pierde la
+// conexion se reintenta y las operaciones se guardan mientras tanto. Al
+// reconectar el handshake indica que mensajes recibio cada lado y solo se
+// reenvia lo que falta, los duplicados los descarta el arbol
 type CausalConn struct {
 	toSend    chan []byte
 	toApply   chan []byte
 	exit      chan bool
 	connected bool
 	wg        sync.WaitGroup
-	conn      net.Conn
+	serverIP  string
+	tree      CRDTTree
+	received  atomic.Uint64 // mensajes recibidos del servidor, ver Ack
+	acked     uint64        // ultimo Ack enviado, solo lo usa processToSend
+	closed    atomic.Bool
+	stop      chan struct{} // se cierra en Close
+	done      chan struct{} // se cierra al terminar run
+	// Conexion actual, nil mientras se reconecta
+	mu          sync.Mutex
+	conn        net.Conn
+	state       ConnState
+	joined      bool     // ya se hizo un handshake con Join
+	legacy      bool     // el servidor es de la version 1, sin sobres
+	heartbeats  bool     // el servidor responde los heartbeats
+	accepting   bool     // el servidor responde los Ack con Accepted
+	unconfirmed [][]byte // mensajes que el servidor puede no tener
+	sentBase    uint64   // mensajes anteriores a unconfirmed, ver Hello.Sent
+	subscribed  []string // se vuelven a suscribir en cada conexion
+	// Lote pendiente, solo lo usa processToSend
+	batching   BatchConfig
+	pending    []byte
+	pendingDoc string
+}
+
+// Agrupa las operaciones salientes en un solo mensaje. El lote se envia
+// al llegar a MaxBytes, despues de MaxDelay desde su primera operacion,
+// o en cuanto la cola se vacia si MaxDelay es cero
+type BatchConfig struct {
+	Enabled  bool
+	MaxBytes int
+	MaxDelay time.Duration
+	Compress bool // comprimir los lotes con DEFLATE
+}
+
+// Operaciones concatenadas de un mismo documento, el servidor las
+// enruta como un solo mensaje. Es el Payload de un TypeBatch
+type batchMessage struct {
+	Document   string
+	Batch      []byte
+	Compressed bool
 }
 
+// serverIP puede ser una URL ws:// o wss://, ver Dial. Si el servidor
+// rechaza el ID de la replica entra en panico, si no se puede conectar
+// se reintenta en segundo plano
 func NewCausalConn(tree CRDTTree, serverIP string) *CausalConn {
 	replica := CausalConn{
 		toSend:    make(chan []byte, 100000),
 		toApply:   make(chan []byte, 100000),
 		exit:      make(chan bool),
 		connected: true,
+		serverIP:  serverIP,
+		tree:      tree,
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+		state:     StateReconnecting,
 	}
 
-	conn, err := net.Dial("tcp", serverIP)
-	if err != nil {
+	c, dec, err := replica.dial()
+	if _, rejected := err.(*RejectedError); rejected {
 		panic(err)
+	} else if err != nil {
+		log.Println("could not connect to the server, retrying:", err)
 	}
 
-	replica.conn = conn
-	go replica.receiveOperations()
+	go replica.run(c, dec)
+	go replica.sendHeartbeats()
 	go replica.processToSend()
 	go replica.processToApply(tree)
 	return &replica
 }
 
+// Se debe llamar antes de enviar operaciones, todas las replicas deben
+// ser capaces de leer lotes
+func (conn *CausalConn) SetBatching(cfg BatchConfig) {
+	conn.batching = cfg
+}
+
 func (conn *CausalConn) Send(data []byte) {
 	conn.toSend <- data
 }
@@ -61,48 +144,400 @@ func (conn *CausalConn) Connect() {
 	}
 }
 
+// Envia lo pendiente y cierra la conexion con el servidor
 func (conn *CausalConn) Close() {
 	close(conn.toSend)
 	conn.wg.Wait()
+	conn.closed.Store(true)
+	close(conn.stop)
+	conn.mu.Lock()
+	if conn.conn != nil {
+		conn.conn.Close()
+	}
+	conn.mu.Unlock()
+	<-conn.done
+	conn.setState(StateClosed)
+}
+
+// Conecta con el servidor y hace el handshake. Se descarta lo que el
+// servidor ya tiene y se reenvia el resto
+func (conn *CausalConn) dial() (net.Conn, *msgpack.Decoder, error) {
+	c, err := Dial(conn.serverIP)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+
+	// el servidor rechaza IDs invalidos o que ya estan conectados
+	dec := msgpack.NewDecoder(c)
+	c.SetDeadline(time.Now().Add(HandshakeTimeout))
+	reply, err := Handshake(c, dec, Hello{
+		ReplicaID: uint64(conn.tree.GetID()),
+		Received:  conn.received.Load(),
+		Sent:      conn.sentBase,
+		Join:      !conn.joined,
+		Resume:    conn.joined,
+		Documents: conn.subscribed,
+		Features:  Features,
+	})
+	if err != nil {
+		c.Close()
+		return nil, nil, err
+	}
+
+	c.SetDeadline(time.Time{})
+	conn.joined = true
+	conn.legacy = reply.Version < 2
+	conn.heartbeats = reply.Supports(FeatureHeartbeat)
+	conn.accepting = reply.Supports(FeatureAccepted)
+	conn.received.Store(reply.Received)
+	conn.confirm(reply.Accepted)
+
+	// la version 1 no recibe los documentos en el handshake
+	if conn.legacy {
+		for _, doc := range conn.subscribed {
+			c.Write(conn.wire(SubscribeMessage(doc)))
+		}
+	}
+
+	for _, data := range conn.unconfirmed {
+		if _, err := c.Write(conn.wire(data)); err != nil {
+			c.Close()
+			return nil, nil, err
+		}
+	}
+
+	conn.conn = c
+	return c, dec, nil
+}
+
+// se llama con mu tomado, el servidor tiene los primeros accepted mensajes
+func (conn *CausalConn) confirm(accepted uint64) {
+	if accepted > conn.sentBase {
+		n := min(accepted-conn.sentBase, uint64(len(conn.unconfirmed)))
+		conn.unconfirmed = append([][]byte(nil), conn.unconfirmed[n:]...)
+		conn.sentBase += n
+	}
+}
+
+// Recibe mientras hay conexion y reconecta cuando se pierde
+func (conn *CausalConn) run(c net.Conn, dec *msgpack.Decoder) {
+	defer close(conn.done)
+	delay := ReconnectMinDelay
+	for {
+		if c != nil {
+			conn.setState(StateConnected)
+			delay = ReconnectMinDelay
+			conn.mu.Lock()
+			heartbeats, legacy := conn.heartbeats, conn.legacy
+			conn.mu.Unlock()
+			conn.receiveOperations(c, dec, heartbeats, legacy)
+			conn.mu.Lock()
+			c.Close()
+			conn.conn = nil
+			conn.mu.Unlock()
+			if conn.closed.Load() {
+				return
+			}
+
+			log.Println("lost connection to the server, reconnecting")
+			conn.setState(StateReconnecting)
+		}
+
+		wait := delay + time.Duration(rand.Int63n(int64(delay)/2+1))
+		delay = min(2*delay, ReconnectMaxDelay)
+		select {
+		case <-time.After(wait):
+		case <-conn.stop:
+			return
+		}
+
+		c, dec, _ = conn.dial()
+	}
+}
+
+// avisa al arbol si le interesa el estado de la conexion
+func (conn *CausalConn) setState(state ConnState) {
+	conn.mu.Lock()
+	changed := conn.state != state
+	conn.state = state
+	conn.mu.Unlock()
+	if listener, ok := conn.tree.(StateListener); ok && changed {
+		listener.ConnectionState(state)
+	}
+}
+
+// se llama con mu tomado, los servidores de la version 1 reciben el
+// mensaje sin sobre
+func (conn *CausalConn) wire(data []byte) []byte {
+	if !conn.legacy {
+		return data
+	}
+
+	env, _ := ReadEnvelope(data)
+	return env.Payload
+}
+
+// Envia data si hay conexion y lo guarda hasta que el servidor lo tenga
+func (conn *CausalConn) write(data []byte) {
+	env, err := ReadEnvelope(data)
+	if err != nil {
+		log.Println("dropping invalid message:", err)
+		return
+	}
+
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+
+	// las suscripciones, Ack y heartbeats no se reenvian al reconectar
+	switch env.Type {
+	case TypeSubscribe:
+		if !slices.Contains(conn.subscribed, env.Document) {
+			conn.subscribed = append(conn.subscribed, env.Document)
+		}
+	case TypeAck, TypeHeartbeat:
+	default:
+		conn.unconfirmed = append(conn.unconfirmed, data)
+		if len(conn.unconfirmed) > MaxUnconfirmed {
+			conn.unconfirmed = conn.unconfirmed[1:]
+			conn.sentBase++
+		}
+	}
+
+	// si falla, run reconecta y se reenvia
+	if conn.conn != nil {
+		if _, err := conn.conn.Write(conn.wire(data)); err != nil {
+			conn.conn.Close()
+		}
+	}
 }
 
 func (conn *CausalConn) processToSend() {
 	conn.wg.Add(1)
 	defer conn.wg.Done()
 
+	// el timer solo corre mientras hay un lote pendiente
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+	defer timer.Stop()
+	// el lote que quedo de antes de Disconnect sale en MaxDelay
+	if len(conn.pending) > 0 {
+		timer.Reset(conn.batching.MaxDelay)
+	}
+	ackTicker := time.NewTicker(AckInterval)
+	defer ackTicker.Stop()
 	for {
 		select {
 		case data, ok := <-conn.toSend:
 			if !ok {
+				conn.flush(timer)
 				return
 			}
 
-			conn.conn.Write(data)
+			if !conn.batching.Enabled {
+				conn.write(data)
+				continue
+			}
+
+			// solo las operaciones van en lotes
+			env, err := ReadEnvelope(data)
+			if err != nil || env.Type != TypeOperation || env.Document != conn.pendingDoc {
+				conn.flush(timer)
+			}
+
+			if err != nil || env.Type != TypeOperation {
+				conn.write(data)
+				continue
+			}
+
+			if len(conn.pending) == 0 {
+				conn.pendingDoc = env.Document
+				timer.Reset(conn.batching.MaxDelay)
+			}
+
+			conn.pending = append(conn.pending, env.Payload...)
+			if len(conn.pending) >= conn.batching.MaxBytes ||
+				(conn.batching.MaxDelay == 0 && len(conn.toSend) == 0) {
+				conn.flush(timer)
+			}
+
+		case <-timer.C:
+			conn.flush(timer)
+
+		case <-ackTicker.C:
+			// el servidor guarda los mensajes hasta que se confirman, y
+			// responde con los que recibio para que la replica los olvide
+			conn.mu.Lock()
+			confirm := conn.accepting && conn.conn != nil && len(conn.unconfirmed) > 0
+			conn.mu.Unlock()
+			if received := conn.received.Load(); received != conn.acked || confirm {
+				conn.write(AckMessage(received))
+				conn.acked = received
+			}
 
 		case <-conn.exit:
+			// el lote pendiente se envia al reconectar
 			return
 		}
 	}
 }
 
-func (conn *CausalConn) receiveOperations() {
-	dec := msgpack.NewDecoder(conn.conn)
+// El servidor responde y asi cada lado sabe que el otro sigue. Los
+// heartbeats siguen despues de Disconnect, que solo detiene las
+// operaciones salientes, si no el servidor cortaria la conexion
+func (conn *CausalConn) sendHeartbeats() {
+	ticker := time.NewTicker(HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-conn.stop:
+			return
+		}
+
+		conn.mu.Lock()
+		heartbeats := conn.heartbeats && conn.conn != nil
+		conn.mu.Unlock()
+		if heartbeats {
+			conn.write(HeartbeatMessage())
+		}
+	}
+}
+
+// envia el lote pendiente y detiene su timer, si ya vencio se vacia el
+// canal para que no corte antes de tiempo el proximo lote
+func (conn *CausalConn) flush(timer *time.Timer) {
+	if !timer.Stop() {
+		select {
+		case <-timer.C:
+		default:
+		}
+	}
+
+	if len(conn.pending) == 0 {
+		return
+	}
+
+	batch := batchMessage{Document: conn.pendingDoc, Batch: conn.pending}
+	if conn.batching.Compress {
+		if compressed, err := deflate(conn.pending); err != nil {
+			log.Println("could not compress batch, sending it uncompressed:", err)
+		} else {
+			batch.Batch = compressed
+			batch.Compressed = true
+		}
+	}
+
+	conn.write(message(TypeBatch, batch.Document, batch))
+	conn.pending = nil
+}
+
+func deflate(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.BestSpeed)
+	if err != nil {
+		return nil, err
+	} else if _, err := w.Write(data); err != nil {
+		return nil, err
+	} else if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// hasta que se pierde la conexion, con heartbeats tambien si el servidor
+// deja de responder. Los mensajes de un servidor de la version 1 se
+// ponen en un sobre segun sus campos
+func (conn *CausalConn) receiveOperations(c net.Conn, dec *msgpack.Decoder, heartbeats, legacy bool) {
 	for {
+		if heartbeats {
+			c.SetReadDeadline(time.Now().Add(HeartbeatTimeout))
+		}
+
 		data, err := dec.DecodeRaw()
 		if err != nil {
-			panic(err)
+			return
+		} else if legacy {
+			data, err = Wrap(data)
+		}
+
+		var env Envelope
+		if err == nil {
+			env, err = ReadEnvelope(data)
+		}
+
+		switch {
+		case err == nil && env.Type == TypeHeartbeat:
+			// no cuenta como mensaje recibido
+			continue
+		case err == nil && env.Type == TypeAck:
+			var ack Ack
+			if msgpack.Unmarshal(env.Payload, &ack) == nil {
+				conn.mu.Lock()
+				conn.confirm(ack.Accepted)
+				conn.mu.Unlock()
+			}
+			continue
 		}
 
 		//log.Println("RECV: " + string(data))
-		conn.toApply <- data
+		conn.received.Add(1)
+		if err != nil {
+			log.Println("dropping invalid message:", err)
+			continue
+		} else if env.Type != TypeBatch {
+			conn.toApply <- data
+			continue
+		}
+
+		var batch batchMessage
+		if err := msgpack.Unmarshal(env.Payload, &batch); err != nil {
+			log.Println("invalid batch:", err)
+			continue
+		}
+
+		// se separa el lote manteniendo el orden de las operaciones
+		var r io.Reader = bytes.NewReader(batch.Batch)
+		if batch.Compressed {
+			r = flate.NewReader(r)
+		}
+
+		opDec := msgpack.NewDecoder(r)
+		for {
+			op, err := opDec.DecodeRaw()
+			if err == io.EOF {
+				break
+			} else if err == nil && legacy {
+				op, err = Wrap(op)
+			} else if err == nil {
+				op = OperationMessage(batch.Document, op)
+			}
+
+			if err != nil {
+				log.Println("invalid batch:", err)
+				break
+			}
+
+			conn.toApply <- op
+		}
 	}
 }
 
+// Se aplican juntos todos los paquetes encolados, asi el arbol revierte
+// su historial una sola vez
 func (conn *CausalConn) processToApply(tree CRDTTree) {
 	for {
 		select {
 		case data := <-conn.toApply:
-			tree.ApplyRemoteOperation(data)
+			packets := [][]byte{data}
+			for n := len(conn.toApply); n > 0; n-- {
+				packets = append(packets, <-conn.toApply)
+			}
+
+			tree.ApplyRemoteOperations(packets)
 		}
 	}
 }
@@ -9,6 +9,8 @@ package network
 type CRDTTree interface {
 	GetID() int
 	ApplyRemoteOperation([]byte)
+	// varios paquetes en orden de llegada, se aplican juntos
+	ApplyRemoteOperations([][]byte)
 }
 
 type ReplicaConn interface {
@@ -17,3 +19,29 @@ type ReplicaConn interface {
 	Disconnect()
 	Close()
 }
+
+// Estado de la conexion con el servidor
+type ConnState int
+
+const (
+	StateConnected    ConnState = iota
+	StateReconnecting           // se perdio la conexion, se reintenta
+	StateClosed
+)
+
+func (state ConnState) String() string {
+	switch state {
+	case StateConnected:
+		return "connected"
+	case StateReconnecting:
+		return "reconnecting"
+	}
+
+	return "closed"
+}
+
+// Lo implementan los arboles que quieren saber cuando cambia el estado
+// de la conexion
+type StateListener interface {
+	ConnectionState(ConnState)
+}
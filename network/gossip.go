@@ -0,0 +1,333 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package network
+
+import (
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+type GossipConfig struct {
+	Fanout   int           // peers con los que se intercambia en cada ronda
+	Interval time.Duration // tiempo entre rondas
+}
+
+var DefaultGossipConfig = GossipConfig{
+	Fanout:   3,
+	Interval: 200 * time.Millisecond,
+}
+
+// Conexion epidemica: en cada ronda se eligen peers al azar y se
+// intercambia con cada uno un resumen de las operaciones conocidas y las
+// operaciones que le faltan al otro. Cada operacion se propaga de replica
+// en replica sin que nadie la envie a todos.
+//
+// Se guardan las operaciones de cada replica en orden para poder
+// entregarlas a las replicas atrasadas, hasta que todos los peers las
+// conocen. Se entregan al arbol en orden causal igual que en MeshConn
+type GossipConn struct {
+	sync.Mutex
+	id        uint64
+	config    GossipConfig
+	peers     []string
+	ln        net.Listener
+	toApply   chan []byte
+	known     map[uint64][]meshPacket      // operaciones de cada replica sin huecos
+	dropped   map[uint64]uint64            // operaciones de cada replica quitadas de known
+	digests   map[uint64]map[uint64]uint64 // ultimo resumen de cada peer
+	delivered map[uint64]uint64
+	connected bool
+	exit      chan struct{}
+	wg        sync.WaitGroup
+}
+
+// Un intercambio son tres mensajes: el resumen del que inicia, el resumen
+// y las operaciones que le faltan al que inicia, y las que le faltan al otro
+type gossipMessage struct {
+	_msgpack struct{} `msgpack:",omitempty"`
+	From     uint64
+	Digest   map[uint64]uint64 // operaciones conocidas de cada replica
+	Packets  []meshPacket
+}
+
+func NewGossipConn(tree CRDTTree, listen string, peers []string, config GossipConfig) *GossipConn {
+	ln, err := net.Listen("tcp", listen)
+	if err != nil {
+		panic(err)
+	}
+
+	gossip := &GossipConn{
+		id:        uint64(tree.GetID()),
+		config:    config,
+		peers:     peers,
+		ln:        ln,
+		toApply:   make(chan []byte, 100000),
+		known:     make(map[uint64][]meshPacket),
+		dropped:   make(map[uint64]uint64),
+		digests:   make(map[uint64]map[uint64]uint64),
+		delivered: make(map[uint64]uint64),
+		connected: true,
+		exit:      make(chan struct{}),
+	}
+
+	gossip.wg.Add(2)
+	go gossip.accept()
+	go gossip.rounds()
+	go applyAll(gossip.toApply, tree)
+	return gossip
+}
+
+func (gossip *GossipConn) Send(data []byte) {
+	gossip.Lock()
+	defer gossip.Unlock()
+
+	clock := make(map[uint64]uint64, len(gossip.delivered)+1)
+	for id, n := range gossip.delivered {
+		clock[id] = n
+	}
+
+	// las operaciones propias de una ejecucion anterior que trajeron los
+	// peers no se vuelven a numerar
+	seq := gossip.dropped[gossip.id] + uint64(len(gossip.known[gossip.id])) + 1
+	clock[gossip.id] = seq
+	gossip.known[gossip.id] = append(gossip.known[gossip.id], meshPacket{From: gossip.id, Clock: clock, Data: data})
+	// si faltan entregar propias anteriores esta se entrega despues de
+	// ellas, el arbol descarta las que ya aplico
+	if gossip.delivered[gossip.id] == seq-1 {
+		gossip.delivered[gossip.id] = seq
+	}
+}
+
+// Deja de intercambiar operaciones hasta Connect
+func (gossip *GossipConn) Disconnect() {
+	gossip.Lock()
+	defer gossip.Unlock()
+
+	gossip.connected = false
+}
+
+func (gossip *GossipConn) Connect() {
+	gossip.Lock()
+	defer gossip.Unlock()
+
+	gossip.connected = true
+}
+
+// Operaciones guardadas para las replicas atrasadas
+func (gossip *GossipConn) Stored() int {
+	gossip.Lock()
+	defer gossip.Unlock()
+
+	stored := 0
+	for _, known := range gossip.known {
+		stored += len(known)
+	}
+
+	return stored
+}
+
+func (gossip *GossipConn) Close() {
+	close(gossip.exit)
+	gossip.ln.Close()
+	gossip.wg.Wait()
+}
+
+func (gossip *GossipConn) rounds() {
+	defer gossip.wg.Done()
+	ticker := time.NewTicker(gossip.config.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-gossip.exit:
+			return
+		}
+
+		gossip.Lock()
+		connected := gossip.connected
+		gossip.Unlock()
+		if !connected {
+			continue
+		}
+
+		var wg sync.WaitGroup
+		for _, i := range rand.Perm(len(gossip.peers))[:min(gossip.config.Fanout, len(gossip.peers))] {
+			wg.Add(1)
+			go func(addr string) {
+				defer wg.Done()
+				gossip.exchange(addr)
+			}(gossip.peers[i])
+		}
+		wg.Wait()
+	}
+}
+
+// Intercambio iniciado por esta replica
+func (gossip *GossipConn) exchange(addr string) {
+	conn, err := net.DialTimeout("tcp", addr, gossip.config.Interval)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	// un peer que no responde no frena las rondas siguientes
+	conn.SetDeadline(time.Now().Add(10 * gossip.config.Interval))
+	dec := msgpack.NewDecoder(conn)
+	gossip.Lock()
+	digest := gossip.digest()
+	gossip.Unlock()
+	if writeGossip(conn, gossipMessage{From: gossip.id, Digest: digest}) != nil {
+		return
+	}
+
+	var reply gossipMessage
+	if dec.Decode(&reply) != nil {
+		return
+	}
+
+	gossip.Lock()
+	gossip.merge(reply.Packets)
+	missing := gossip.missing(reply.Digest)
+	gossip.collect(reply.From, reply.Digest)
+	gossip.Unlock()
+	writeGossip(conn, gossipMessage{From: gossip.id, Packets: missing})
+}
+
+func (gossip *GossipConn) accept() {
+	defer gossip.wg.Done()
+	for {
+		conn, err := gossip.ln.Accept()
+		if err != nil {
+			return
+		}
+
+		gossip.wg.Add(1)
+		go gossip.serve(conn)
+	}
+}
+
+// Intercambio iniciado por un peer
+func (gossip *GossipConn) serve(conn net.Conn) {
+	defer gossip.wg.Done()
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(10 * gossip.config.Interval))
+	dec := msgpack.NewDecoder(conn)
+	var request gossipMessage
+	if dec.Decode(&request) != nil {
+		return
+	}
+
+	gossip.Lock()
+	if !gossip.connected {
+		gossip.Unlock()
+		return
+	}
+
+	reply := gossipMessage{From: gossip.id, Digest: gossip.digest(), Packets: gossip.missing(request.Digest)}
+	gossip.collect(request.From, request.Digest)
+	gossip.Unlock()
+	if writeGossip(conn, reply) != nil {
+		return
+	}
+
+	var rest gossipMessage
+	if dec.Decode(&rest) != nil {
+		return
+	}
+
+	gossip.Lock()
+	gossip.merge(rest.Packets)
+	gossip.Unlock()
+}
+
+func writeGossip(conn net.Conn, message gossipMessage) error {
+	data, err := msgpack.Marshal(message)
+	if err != nil {
+		panic(err)
+	}
+
+	_, err = conn.Write(data)
+	return err
+}
+
+// se llama con el lock tomado
+func (gossip *GossipConn) digest() map[uint64]uint64 {
+	digest := make(map[uint64]uint64, len(gossip.known))
+	for id, packets := range gossip.known {
+		digest[id] = gossip.dropped[id] + uint64(len(packets))
+	}
+
+	return digest
+}
+
+// se llama con el lock tomado, operaciones que no estan en digest. Las
+// que ya se quitaron de known no se pueden enviar
+func (gossip *GossipConn) missing(digest map[uint64]uint64) []meshPacket {
+	var packets []meshPacket
+	for id, known := range gossip.known {
+		if n := max(digest[id], gossip.dropped[id]) - gossip.dropped[id]; n < uint64(len(known)) {
+			packets = append(packets, known[n:]...)
+		}
+	}
+
+	return packets
+}
+
+// se llama con el lock tomado con el resumen de un peer. Cuando se tiene
+// un resumen de cada peer se quitan de known las operaciones que todos
+// conocen y ya se entregaron al arbol, los resumenes solo crecen
+func (gossip *GossipConn) collect(from uint64, digest map[uint64]uint64) {
+	if from == gossip.id || digest == nil {
+		return
+	}
+
+	gossip.digests[from] = digest
+	if len(gossip.digests) < len(gossip.peers) {
+		return
+	}
+
+	for id, known := range gossip.known {
+		n := gossip.delivered[id]
+		for _, digest := range gossip.digests {
+			n = min(n, digest[id])
+		}
+
+		if n > gossip.dropped[id] {
+			gossip.known[id] = append([]meshPacket(nil), known[n-gossip.dropped[id]:]...)
+			gossip.dropped[id] = n
+		}
+	}
+}
+
+// se llama con el lock tomado. Las operaciones que ya se conocen se
+// descartan, las que dejan un hueco tambien y llegan en otra ronda
+func (gossip *GossipConn) merge(packets []meshPacket) {
+	for _, p := range packets {
+		if p.Clock[p.From] == gossip.dropped[p.From]+uint64(len(gossip.known[p.From]))+1 {
+			gossip.known[p.From] = append(gossip.known[p.From], p)
+		}
+	}
+
+	// las propias de una ejecucion anterior tambien se entregan, el arbol
+	// no las tiene despues de reiniciar
+	for progress := true; progress; {
+		progress = false
+		for id, known := range gossip.known {
+			n := gossip.delivered[id] - gossip.dropped[id]
+			if n < uint64(len(known)) && deliverable(gossip.delivered, known[n]) {
+				gossip.delivered[id]++
+				gossip.toApply <- known[n].Data
+				progress = true
+			}
+		}
+	}
+}
@@ -0,0 +1,410 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package network
+
+import (
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Cada cuanto se reintenta la conexion con un peer
+const MeshRetryInterval = time.Second
+
+// Conexion sin servidor: cada replica abre una conexion TCP con cada peer
+// para enviarle sus propias operaciones y recibe las de los peers en las
+// conexiones que acepta. La entrega es causal con relojes vectoriales.
+//
+// Las operaciones propias se guardan hasta que todos los peers confirman
+// que las recibieron, asi se reenvian cuando un peer se reconecta
+type MeshConn struct {
+	sync.Mutex
+	id        uint64
+	peers     []string
+	ln        net.Listener
+	toApply   chan []byte
+	delivered map[uint64]uint64 // reloj vectorial, mensajes entregados de cada replica
+	pending   []meshPacket      // mensajes que esperan a sus dependencias
+	sent      []meshPacket      // mensajes propios sin confirmar por todos
+	acked     map[string]uint64 // mensajes propios confirmados por cada peer
+	links     map[string]*meshLink
+	inbound   map[net.Conn]bool
+	connected bool
+	closed    bool
+	wg        sync.WaitGroup
+}
+
+// Mensaje entre peers. Hello abre una conexion y su respuesta trae en
+// Delivered cuantos mensajes propios ya recibio el peer, los Ack traen lo
+// mismo. Los demas mensajes traen una operacion y el reloj del emisor
+type meshPacket struct {
+	_msgpack  struct{} `msgpack:",omitempty"`
+	From      uint64
+	Hello     bool
+	Delivered uint64
+	Clock     map[uint64]uint64
+	Data      []byte
+}
+
+// Conexion saliente con un peer
+type meshLink struct {
+	addr   string
+	conn   net.Conn
+	notify chan struct{}
+	done   chan struct{}
+}
+
+// listen es la direccion en la que se aceptan los peers, peers son las
+// direcciones de las demas replicas
+func NewMeshConn(tree CRDTTree, listen string, peers []string) *MeshConn {
+	ln, err := net.Listen("tcp", listen)
+	if err != nil {
+		panic(err)
+	}
+
+	mesh := &MeshConn{
+		id:        uint64(tree.GetID()),
+		peers:     peers,
+		ln:        ln,
+		toApply:   make(chan []byte, 100000),
+		delivered: make(map[uint64]uint64),
+		acked:     make(map[string]uint64),
+		links:     make(map[string]*meshLink),
+		inbound:   make(map[net.Conn]bool),
+		connected: true,
+	}
+
+	go mesh.accept()
+	go applyAll(mesh.toApply, tree)
+	for _, addr := range peers {
+		mesh.wg.Add(1)
+		go mesh.dial(addr)
+	}
+
+	return mesh
+}
+
+func (mesh *MeshConn) Send(data []byte) {
+	mesh.Lock()
+	defer mesh.Unlock()
+
+	mesh.delivered[mesh.id]++
+	clock := make(map[uint64]uint64, len(mesh.delivered))
+	for id, n := range mesh.delivered {
+		clock[id] = n
+	}
+
+	mesh.sent = append(mesh.sent, meshPacket{From: mesh.id, Clock: clock, Data: data})
+	for _, link := range mesh.links {
+		link.wake()
+	}
+}
+
+// Deja de enviar operaciones, se siguen guardando para enviarlas al
+// reconectar
+func (mesh *MeshConn) Disconnect() {
+	mesh.Lock()
+	defer mesh.Unlock()
+
+	mesh.connected = false
+	for _, link := range mesh.links {
+		link.conn.Close()
+	}
+}
+
+func (mesh *MeshConn) Connect() {
+	mesh.Lock()
+	defer mesh.Unlock()
+
+	mesh.connected = true
+}
+
+func (mesh *MeshConn) Close() {
+	mesh.Lock()
+	mesh.closed = true
+	mesh.ln.Close()
+	for _, link := range mesh.links {
+		link.conn.Close()
+	}
+	for conn := range mesh.inbound {
+		conn.Close()
+	}
+	mesh.Unlock()
+	mesh.wg.Wait()
+}
+
+func (link *meshLink) wake() {
+	select {
+	case link.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Mantiene la conexion saliente con addr, reconectando si se cae
+func (mesh *MeshConn) dial(addr string) {
+	defer mesh.wg.Done()
+	for {
+		mesh.Lock()
+		closed, connected := mesh.closed, mesh.connected
+		mesh.Unlock()
+		if closed {
+			return
+		} else if connected {
+			if conn, err := net.Dial("tcp", addr); err == nil {
+				mesh.serveLink(addr, conn)
+			}
+		}
+
+		time.Sleep(MeshRetryInterval)
+	}
+}
+
+// Envia los mensajes propios que el peer no tiene y lee sus Ack
+func (mesh *MeshConn) serveLink(addr string, conn net.Conn) {
+	defer conn.Close()
+	dec := msgpack.NewDecoder(conn)
+	if err := writePacket(conn, meshPacket{From: mesh.id, Hello: true}); err != nil {
+		return
+	}
+
+	var reply meshPacket
+	if err := dec.Decode(&reply); err != nil || !reply.Hello {
+		return
+	}
+
+	link := &meshLink{addr, conn, make(chan struct{}, 1), make(chan struct{})}
+	mesh.Lock()
+	if mesh.closed || !mesh.connected {
+		mesh.Unlock()
+		return
+	}
+
+	mesh.links[addr] = link
+	mesh.ack(addr, reply.Delivered)
+	sent := reply.Delivered
+	mesh.Unlock()
+
+	go func() {
+		for {
+			var ack meshPacket
+			if err := dec.Decode(&ack); err != nil {
+				close(link.done)
+				return
+			}
+
+			mesh.Lock()
+			mesh.ack(addr, ack.Delivered)
+			mesh.Unlock()
+		}
+	}()
+
+	link.wake()
+	for {
+		select {
+		case <-link.notify:
+		case <-link.done:
+			mesh.Lock()
+			if mesh.links[addr] == link {
+				delete(mesh.links, addr)
+			}
+			mesh.Unlock()
+			return
+		}
+
+		mesh.Lock()
+		packets := mesh.after(sent)
+		mesh.Unlock()
+		for _, packet := range packets {
+			if writePacket(conn, packet) != nil {
+				conn.Close()
+				break
+			}
+
+			sent = packet.Clock[mesh.id]
+		}
+	}
+}
+
+// se llama con el lock tomado. Un peer que reporta mas mensajes propios
+// de los que hay es porque la replica se reinicio, se sigue contando
+// desde ahi para que sus mensajes nuevos no parezcan duplicados
+func (mesh *MeshConn) ack(addr string, delivered uint64) {
+	if delivered > mesh.delivered[mesh.id] {
+		log.Println("mesh: peer", addr, "has", delivered-mesh.delivered[mesh.id], "operations of a previous run")
+		mesh.delivered[mesh.id] = delivered
+	}
+
+	mesh.acked[addr] = max(mesh.acked[addr], delivered)
+	if len(mesh.acked) < len(mesh.peers) {
+		return
+	}
+
+	// se descartan los mensajes que todos los peers confirmaron
+	all := delivered
+	for _, n := range mesh.acked {
+		all = min(all, n)
+	}
+
+	i := sort.Search(len(mesh.sent), func(i int) bool {
+		return mesh.sent[i].Clock[mesh.id] > all
+	})
+	mesh.sent = append([]meshPacket(nil), mesh.sent[i:]...)
+}
+
+// mensajes propios con numero mayor a seq
+func (mesh *MeshConn) after(seq uint64) []meshPacket {
+	i := sort.Search(len(mesh.sent), func(i int) bool {
+		return mesh.sent[i].Clock[mesh.id] > seq
+	})
+
+	return mesh.sent[i:len(mesh.sent):len(mesh.sent)]
+}
+
+func writePacket(conn net.Conn, packet meshPacket) error {
+	data, err := msgpack.Marshal(packet)
+	if err != nil {
+		panic(err)
+	}
+
+	_, err = conn.Write(data)
+	return err
+}
+
+func (mesh *MeshConn) accept() {
+	for {
+		conn, err := mesh.ln.Accept()
+		if err != nil {
+			return
+		}
+
+		mesh.Lock()
+		if mesh.closed {
+			conn.Close()
+		} else {
+			mesh.inbound[conn] = true
+			mesh.wg.Add(1)
+			go mesh.receive(conn)
+		}
+		mesh.Unlock()
+	}
+}
+
+// Recibe los mensajes de un peer y le confirma cuantos se entregaron
+func (mesh *MeshConn) receive(conn net.Conn) {
+	defer mesh.wg.Done()
+	defer func() {
+		mesh.Lock()
+		delete(mesh.inbound, conn)
+		mesh.Unlock()
+		conn.Close()
+	}()
+	dec := msgpack.NewDecoder(conn)
+	var hello meshPacket
+	if err := dec.Decode(&hello); err != nil || !hello.Hello {
+		return
+	}
+
+	from := hello.From
+	mesh.Lock()
+	delivered := mesh.delivered[from]
+	mesh.Unlock()
+	if writePacket(conn, meshPacket{From: mesh.id, Hello: true, Delivered: delivered}) != nil {
+		return
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(AckInterval)
+		defer ticker.Stop()
+		acked := delivered
+		for {
+			select {
+			case <-ticker.C:
+				mesh.Lock()
+				delivered := mesh.delivered[from]
+				mesh.Unlock()
+				if delivered != acked {
+					writePacket(conn, meshPacket{From: mesh.id, Delivered: delivered})
+					acked = delivered
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	for {
+		var packet meshPacket
+		if err := dec.Decode(&packet); err != nil {
+			return
+		}
+
+		mesh.Lock()
+		mesh.deliver(packet)
+		mesh.Unlock()
+	}
+}
+
+// se llama con el lock tomado. Los duplicados se descartan y los
+// mensajes se entregan en cuanto se entregaron sus dependencias
+func (mesh *MeshConn) deliver(packet meshPacket) {
+	if packet.Clock[packet.From] <= mesh.delivered[packet.From] {
+		return
+	}
+
+	mesh.pending = append(mesh.pending, packet)
+	for progress := true; progress; {
+		progress = false
+		for i := 0; i < len(mesh.pending); i++ {
+			p := mesh.pending[i]
+			if p.Clock[p.From] <= mesh.delivered[p.From] {
+				// duplicado que llego mientras esperaba
+				mesh.pending = append(mesh.pending[:i], mesh.pending[i+1:]...)
+				i--
+			} else if deliverable(mesh.delivered, p) {
+				mesh.delivered[p.From]++
+				mesh.toApply <- p.Data
+				mesh.pending = append(mesh.pending[:i], mesh.pending[i+1:]...)
+				i--
+				progress = true
+			}
+		}
+	}
+}
+
+// p es el siguiente mensaje de su emisor y ya se entrego todo lo que el
+// emisor habia entregado al enviarlo
+func deliverable(delivered map[uint64]uint64, p meshPacket) bool {
+	if p.Clock[p.From] != delivered[p.From]+1 {
+		return false
+	}
+
+	for id, n := range p.Clock {
+		if id != p.From && n > delivered[id] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// aplica los mensajes de toApply en orden, juntando los que ya llegaron
+func applyAll(toApply chan []byte, tree CRDTTree) {
+	for data := range toApply {
+		packets := [][]byte{data}
+		for n := len(toApply); n > 0; n-- {
+			packets = append(packets, <-toApply)
+		}
+
+		tree.ApplyRemoteOperations(packets)
+	}
+}
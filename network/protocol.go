@@ -0,0 +1,354 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package network
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"slices"
+	"time"
+
+	"github.com/vmihailenco/msgpack/v5"
+	"github.com/vmihailenco/msgpack/v5/msgpcode"
+)
+
+// Las operaciones con el codec compacto van en un bin de MessagePack
+// que empieza con CompactMagic y el documento (uvarint de largo y
+// bytes), el resto del formato lo define crdt
+const CompactMagic = 'c'
+
+// Version del protocolo. Los Hello sin Version son de la version 1, sin
+// heartbeats ni documentos en el handshake
+const ProtocolVersion = 2
+
+// Funciones opcionales que se acuerdan en el handshake
+const (
+	FeatureHeartbeat = "heartbeat" // ver Heartbeat
+	FeatureCodecs    = "codecs"    // recibe mensajes Capabilities
+	FeatureAccepted  = "accepted"  // recibe Ack con Accepted
+)
+
+// Funciones que entiende esta version
+var Features = []string{FeatureHeartbeat, FeatureCodecs, FeatureAccepted}
+
+// Cada cuanto se envia un heartbeat, sin mensajes durante
+// HeartbeatTimeout la conexion se da por perdida
+const (
+	HeartbeatInterval = 5 * time.Second
+	HeartbeatTimeout  = 3 * HeartbeatInterval
+)
+
+// Desde la version 2 los mensajes despues del handshake van en un sobre
+// con su tipo y su documento, el servidor los enruta sin leer Payload.
+// Payload es el mensaje de la version 1, asi el servidor y CausalConn lo
+// pasan sin cambios a los pares de la version 1. Los Hello no van en
+// sobre, la version se conoce despues del handshake
+type Envelope struct {
+	_msgpack struct{} `msgpack:",as_array"`
+	Type     MessageType
+	Document string
+	Payload  []byte
+}
+
+// Tipo de un mensaje. Los valores van en el sobre, los tipos nuevos se
+// agregan al final
+type MessageType uint8
+
+const (
+	TypeOperation    MessageType = iota // operaciones de un documento
+	TypeHello                           // ver Hello
+	TypeSubscribe                       // ver SubscribeMessage
+	TypeCapabilities                    // ver Capabilities
+	TypeAck                             // ver Ack
+	TypeSnapshot                        // estado de un documento, ver Snapshot
+	TypeHeartbeat                       // ver HeartbeatMessage
+	TypeSyncRequest                     // Snapshot sin Data, pedido de estado o del log
+	TypeBatch                           // lote de operaciones, ver BatchConfig
+)
+
+func (env Envelope) Bytes() []byte {
+	data, err := msgpack.Marshal(env)
+	if err != nil {
+		panic(err)
+	}
+
+	return data
+}
+
+// Si data es un sobre, los mensajes de la version 1 son mapas o bins
+func IsEnvelope(data []byte) bool {
+	return len(data) > 0 && (msgpcode.IsFixedArray(data[0]) ||
+		data[0] == msgpcode.Array16 || data[0] == msgpcode.Array32)
+}
+
+func ReadEnvelope(data []byte) (Envelope, error) {
+	var env Envelope
+	if !IsEnvelope(data) {
+		return env, errors.New("message is not an envelope")
+	}
+
+	err := msgpack.Unmarshal(data, &env)
+	return env, err
+}
+
+// Sobre con el mensaje v de la version 1
+func message(t MessageType, doc string, v any) []byte {
+	payload, err := msgpack.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+
+	return Envelope{Type: t, Document: doc, Payload: payload}.Bytes()
+}
+
+// Campos de un mensaje de la version 1. Las operaciones sin documento
+// pertenecen al documento por defecto ""
+type Header struct {
+	_msgpack  struct{} `msgpack:",omitempty"`
+	Document  string
+	Subscribe string   // mensaje de control para recibir un documento
+	Codecs    []string // mensaje con los codecs que entiende una replica
+	Hello     bool     // primer mensaje de la conexion, ver Hello
+	Ack       bool     // confirmacion de mensajes recibidos, ver Ack
+	Snapshot  bool     // pedido o estado de un documento, ver Snapshot
+	Heartbeat bool     // la conexion sigue viva, no lleva datos
+	// el estado trae Data, sin leerlo, los pedidos no
+	HasData present `msgpack:"Data"`
+	Batch   present // ver batchMessage
+}
+
+// Campo que solo indica si esta en el mensaje, su valor se saltea
+type present bool
+
+func (p *present) DecodeMsgpack(dec *msgpack.Decoder) error {
+	*p = true
+	return dec.Skip()
+}
+
+// En la version 1 el tipo lo da el campo de control que tiene el
+// mensaje. Si tiene varios manda el primero en este orden: Hello,
+// Subscribe, Codecs, Ack, Snapshot, Heartbeat y Batch
+func (header Header) Type() MessageType {
+	switch {
+	case header.Hello:
+		return TypeHello
+	case header.Subscribe != "":
+		return TypeSubscribe
+	case header.Codecs != nil:
+		return TypeCapabilities
+	case header.Ack:
+		return TypeAck
+	case header.Snapshot && !bool(header.HasData):
+		return TypeSyncRequest
+	case header.Snapshot:
+		return TypeSnapshot
+	case header.Heartbeat:
+		return TypeHeartbeat
+	case bool(header.Batch):
+		return TypeBatch
+	}
+
+	return TypeOperation
+}
+
+// Sobre de un mensaje de un par de la version 1, el tipo y el documento
+// salen de sus campos
+func Wrap(data []byte) ([]byte, error) {
+	header, err := ReadHeader(data)
+	if err != nil {
+		return nil, err
+	}
+
+	doc := header.Document
+	if header.Type() == TypeSubscribe {
+		doc = header.Subscribe
+	}
+
+	return Envelope{Type: header.Type(), Document: doc, Payload: data}.Bytes(), nil
+}
+
+// Mensaje con los codecs que entiende una replica para un documento. Las
+// replicas anteriores lo leen como una operacion, el servidor solo lo
+// envia a las replicas con FeatureCodecs
+type Capabilities struct {
+	_msgpack  struct{} `msgpack:",omitempty"`
+	ReplicaID uint64
+	Document  string
+	Codecs    []string
+}
+
+// Primer mensaje de una conexion con el servidor. La replica manda su
+// ID o pide uno libre con Assign, el servidor responde con el ID de la
+// replica o con Error y cierra la conexion.
+//
+// Received es la cantidad de mensajes que la replica recibio del
+// servidor. El servidor responde desde que mensaje va a reenviar los
+// mensajes pendientes y la replica sigue contando desde ahi.
+//
+// En el otro sentido Sent es la cantidad de mensajes que la replica ya no
+// guarda para reenviar. El servidor responde en Accepted cuantos mensajes
+// de la replica recibio contando desde ahi, si no lo sabe responde Sent,
+// y la replica reenvia los siguientes.
+//
+// Desde la version 2 la replica manda los documentos que abrio, que
+// equivalen a suscribirse a cada uno, y las funciones opcionales que
+// entiende. El servidor responde su version y las funciones en comun
+type Hello struct {
+	_msgpack  struct{} `msgpack:",omitempty"`
+	Hello     bool
+	Version   uint32
+	ReplicaID uint64
+	Assign    bool
+	Received  uint64
+	Sent      uint64
+	Accepted  uint64
+	Join      bool // la replica no tiene estado, ver Snapshot
+	Resume    bool // la replica reconecta despues de perder la conexion
+	Documents []string
+	Features  []string
+	Error     string
+}
+
+// Si features incluye feature
+func (hello Hello) Supports(feature string) bool {
+	return slices.Contains(hello.Features, feature)
+}
+
+// Estado de un documento. Sin Data es un TypeSyncRequest: un pedido del
+// servidor a una replica, que responde con su estado, o un pedido de una
+// replica que perdio mensajes, y el servidor le reenvia el log. El
+// servidor guarda el ultimo estado y las operaciones posteriores, y se
+// los envia a las replicas que se unen con Hello.Join o que se suscriben
+// al documento
+type Snapshot struct {
+	_msgpack struct{} `msgpack:",omitempty"`
+	Snapshot bool
+	Document string
+	Data     []byte
+}
+
+// La replica confirma que recibio Received mensajes, el servidor ya no
+// necesita guardarlos. Con FeatureAccepted el servidor responde cada Ack
+// con Accepted igual que en Hello, y la replica deja de guardar esos
+// mensajes para reenviar. La respuesta no cuenta como mensaje recibido
+type Ack struct {
+	_msgpack struct{} `msgpack:",omitempty"`
+	Ack      bool
+	Received uint64
+	Accepted uint64
+}
+
+// Lee la cabecera del primer mensaje de data de la version 1
+func ReadHeader(data []byte) (Header, error) {
+	var header Header
+	dec := msgpack.NewDecoder(bytes.NewReader(data))
+	code, err := dec.PeekCode()
+	if err != nil {
+		return header, err
+	} else if !msgpcode.IsBin(code) {
+		err = dec.Decode(&header)
+		return header, err
+	}
+
+	frame, err := dec.DecodeBytes()
+	if err != nil {
+		return header, err
+	}
+
+	header.Document, err = CompactDocument(frame)
+	return header, err
+}
+
+// Documento de un mensaje del codec compacto
+func CompactDocument(frame []byte) (string, error) {
+	if len(frame) == 0 || frame[0] != CompactMagic {
+		return "", errors.New("invalid compact frame")
+	}
+
+	size, n := binary.Uvarint(frame[1:])
+	if n <= 0 || uint64(len(frame)-1-n) < size {
+		return "", errors.New("invalid compact frame")
+	}
+
+	return string(frame[1+n : 1+n+int(size)]), nil
+}
+
+// Operaciones de doc, una o varias concatenadas. El formato lo define crdt
+func OperationMessage(doc string, ops []byte) []byte {
+	return Envelope{Type: TypeOperation, Document: doc, Payload: ops}.Bytes()
+}
+
+// Mensaje para que el servidor envie las operaciones del documento doc
+func SubscribeMessage(doc string) []byte {
+	return message(TypeSubscribe, doc, Header{Subscribe: doc})
+}
+
+func CapabilitiesMessage(caps Capabilities) []byte {
+	return message(TypeCapabilities, caps.Document, caps)
+}
+
+func AckMessage(received uint64) []byte {
+	return message(TypeAck, "", Ack{Ack: true, Received: received})
+}
+
+func AcceptedMessage(accepted uint64) []byte {
+	return message(TypeAck, "", Ack{Ack: true, Accepted: accepted})
+}
+
+// El servidor rechazo el handshake, reintentar no sirve
+type RejectedError struct {
+	Reason string
+}
+
+func (err *RejectedError) Error() string {
+	return "handshake: " + err.Reason
+}
+
+// Manda hello al servidor y espera su respuesta, dec debe leer de conn.
+// Sin Version se manda la version actual
+func Handshake(conn io.Writer, dec *msgpack.Decoder, hello Hello) (Hello, error) {
+	hello.Hello = true
+	if hello.Version == 0 {
+		hello.Version = ProtocolVersion
+	}
+
+	data, err := msgpack.Marshal(hello)
+	if err != nil {
+		panic(err)
+	}
+
+	var reply Hello
+	if _, err = conn.Write(data); err != nil {
+		return reply, err
+	}
+
+	if err = dec.Decode(&reply); err != nil {
+		return reply, err
+	} else if !reply.Hello {
+		return reply, errors.New("handshake: unexpected message from server")
+	} else if reply.Error != "" {
+		return reply, &RejectedError{reply.Error}
+	}
+
+	return reply, nil
+}
+
+func HeartbeatMessage() []byte {
+	return message(TypeHeartbeat, "", Header{Heartbeat: true})
+}
+
+func SnapshotMessage(snapshot Snapshot) []byte {
+	snapshot.Snapshot = true
+	return message(TypeSnapshot, snapshot.Document, snapshot)
+}
+
+// Pedido del estado de doc o de su log, ver Snapshot
+func SyncRequestMessage(doc string) []byte {
+	return message(TypeSyncRequest, doc, Snapshot{Snapshot: true, Document: doc})
+}
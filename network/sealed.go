@@ -0,0 +1,245 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package network
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Claves AES del documento por version. Se cifra con la version actual
+// y se guardan las anteriores para descifrar operaciones viejas
+type KeyRing struct {
+	sync.Mutex
+	current uint32
+	keys    map[uint32]cipher.AEAD
+}
+
+// Mensaje cifrado, el documento queda en claro para que los servidores
+// de la version 1 lo puedan enrutar y se usa como dato adicional
+// autenticado
+type sealedMessage struct {
+	Document   string
+	KeyVersion uint32
+	Nonce      []byte
+	Sealed     []byte
+}
+
+func NewKeyRing() *KeyRing {
+	return &KeyRing{keys: make(map[uint32]cipher.AEAD)}
+}
+
+// Agrega una clave de 16, 24 o 32 bytes. La version mas alta es la
+// que se usa para cifrar, asi rotar la clave es agregar una version nueva
+func (ring *KeyRing) Add(version uint32, key []byte) error {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+
+	ring.Lock()
+	defer ring.Unlock()
+
+	ring.keys[version] = gcm
+	if version > ring.current || len(ring.keys) == 1 {
+		ring.current = version
+	}
+
+	return nil
+}
+
+// Lee un archivo con una linea "[version] [clave en base64]" por clave
+func LoadKeyRing(path string) (*KeyRing, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+	ring := NewKeyRing()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		} else if len(fields) != 2 {
+			return nil, errors.New("keyring: invalid line")
+		}
+
+		version, err := strconv.ParseUint(fields[0], 10, 32)
+		if err != nil {
+			return nil, err
+		}
+
+		key, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil {
+			return nil, err
+		}
+
+		if err := ring.Add(uint32(version), key); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	} else if len(ring.keys) == 0 {
+		return nil, errors.New("keyring: no keys in " + path)
+	}
+
+	return ring, nil
+}
+
+func (ring *KeyRing) seal(doc string, data []byte) []byte {
+	ring.Lock()
+	version := ring.current
+	gcm := ring.keys[version]
+	ring.Unlock()
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		panic(err)
+	}
+
+	msg, err := msgpack.Marshal(sealedMessage{
+		Document:   doc,
+		KeyVersion: version,
+		Nonce:      nonce,
+		Sealed:     gcm.Seal(nil, nonce, data, []byte(doc)),
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	return msg
+}
+
+func (ring *KeyRing) open(data []byte) ([]byte, error) {
+	var msg sealedMessage
+	if err := msgpack.Unmarshal(data, &msg); err != nil {
+		return nil, err
+	} else if msg.Sealed == nil {
+		return nil, errors.New("keyring: message is not encrypted")
+	}
+
+	ring.Lock()
+	gcm, ok := ring.keys[msg.KeyVersion]
+	ring.Unlock()
+	if !ok {
+		return nil, errors.New("keyring: unknown key version " + strconv.Itoa(int(msg.KeyVersion)))
+	} else if len(msg.Nonce) != gcm.NonceSize() {
+		return nil, errors.New("keyring: invalid nonce")
+	}
+
+	return gcm.Open(nil, msg.Nonce, msg.Sealed, []byte(msg.Document))
+}
+
+// Capa de cifrado entre el arbol y otra conexion, el servidor solo ve
+// el documento y el texto cifrado
+type SealedConn struct {
+	conn ReplicaConn
+	ring *KeyRing
+}
+
+// Lo que recibe el arbol pasa primero por el descifrado
+type sealedTree struct {
+	CRDTTree
+	ring *KeyRing
+}
+
+// el estado de la conexion llega al arbol sin cambios
+func (tree sealedTree) ConnectionState(state ConnState) {
+	if listener, ok := tree.CRDTTree.(StateListener); ok {
+		listener.ConnectionState(state)
+	}
+}
+
+func (tree sealedTree) ApplyRemoteOperation(data []byte) {
+	tree.ApplyRemoteOperations([][]byte{data})
+}
+
+// Con cifrado no se aceptan estados de documento, cualquier replica con
+// la clave podria reemplazar el arbol de las demas. Los pedidos del
+// servidor se descartan sin avisar, asi guarda todo el log
+func (tree sealedTree) ApplyRemoteOperations(packets [][]byte) {
+	var opened [][]byte
+	for _, data := range packets {
+		env, err := ReadEnvelope(data)
+		if err == nil && env.Type == TypeSyncRequest {
+			continue
+		} else if err == nil && env.Type == TypeSnapshot {
+			err = errors.New("keyring: snapshots are not accepted")
+		} else if err == nil {
+			env.Payload, err = tree.ring.open(env.Payload)
+		}
+
+		if err != nil {
+			log.Println("rejected message:", err)
+			continue
+		}
+
+		opened = append(opened, env.Bytes())
+	}
+
+	if len(opened) > 0 {
+		tree.CRDTTree.ApplyRemoteOperations(opened)
+	}
+}
+
+// dial crea la conexion interna, por ejemplo con NewCausalConn
+func NewSealedConn(tree CRDTTree, ring *KeyRing, dial func(CRDTTree) ReplicaConn) *SealedConn {
+	return &SealedConn{
+		conn: dial(sealedTree{tree, ring}),
+		ring: ring,
+	}
+}
+
+// Los mensajes de control y los pedidos del log no se cifran, los estados
+// no se envian. El tipo queda en claro para que el servidor lo enrute
+func (conn *SealedConn) Send(data []byte) {
+	env, err := ReadEnvelope(data)
+	if err != nil {
+		panic(err)
+	}
+
+	switch env.Type {
+	case TypeSubscribe, TypeSyncRequest:
+		conn.conn.Send(data)
+	case TypeSnapshot:
+	default:
+		env.Payload = conn.ring.seal(env.Document, env.Payload)
+		conn.conn.Send(env.Bytes())
+	}
+}
+
+func (conn *SealedConn) Connect() {
+	conn.conn.Connect()
+}
+
+func (conn *SealedConn) Disconnect() {
+	conn.conn.Disconnect()
+}
+
+func (conn *SealedConn) Close() {
+	conn.conn.Close()
+}
@@ -0,0 +1,113 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package network
+
+import (
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Ruta del endpoint WebSocket del servidor
+const WebSocketPath = "/ws"
+
+// Conexion WebSocket vista como un net.Conn. Cada Write es un mensaje
+// binario con un mensaje msgpack, Read lee los mensajes uno detras de
+// otro como si fueran un stream TCP
+type WebSocketConn struct {
+	ws     *websocket.Conn
+	reader io.Reader // mensaje que se esta leyendo
+	wmu    sync.Mutex
+}
+
+func NewWebSocketConn(ws *websocket.Conn) *WebSocketConn {
+	return &WebSocketConn{ws: ws}
+}
+
+// Conecta con el servidor por TCP o, si addr empieza con ws:// o wss://,
+// por WebSocket
+func Dial(addr string) (net.Conn, error) {
+	if !strings.HasPrefix(addr, "ws://") && !strings.HasPrefix(addr, "wss://") {
+		return net.Dial("tcp", addr)
+	}
+
+	ws, _, err := websocket.DefaultDialer.Dial(addr, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewWebSocketConn(ws), nil
+}
+
+func (conn *WebSocketConn) Read(p []byte) (int, error) {
+	for {
+		if conn.reader == nil {
+			_, reader, err := conn.ws.NextReader()
+			if err != nil {
+				return 0, err
+			}
+
+			conn.reader = reader
+		}
+
+		n, err := conn.reader.Read(p)
+		if err == io.EOF {
+			conn.reader = nil
+			if n == 0 {
+				continue
+			}
+
+			err = nil
+		}
+
+		return n, err
+	}
+}
+
+// varias goroutines pueden escribir, gorilla admite un solo escritor
+func (conn *WebSocketConn) Write(p []byte) (int, error) {
+	conn.wmu.Lock()
+	defer conn.wmu.Unlock()
+
+	if err := conn.ws.WriteMessage(websocket.BinaryMessage, p); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+func (conn *WebSocketConn) Close() error {
+	return conn.ws.Close()
+}
+
+func (conn *WebSocketConn) LocalAddr() net.Addr {
+	return conn.ws.LocalAddr()
+}
+
+func (conn *WebSocketConn) RemoteAddr() net.Addr {
+	return conn.ws.RemoteAddr()
+}
+
+func (conn *WebSocketConn) SetDeadline(t time.Time) error {
+	if err := conn.ws.SetReadDeadline(t); err != nil {
+		return err
+	}
+
+	return conn.ws.SetWriteDeadline(t)
+}
+
+func (conn *WebSocketConn) SetReadDeadline(t time.Time) error {
+	return conn.ws.SetReadDeadline(t)
+}
+
+func (conn *WebSocketConn) SetWriteDeadline(t time.Time) error {
+	return conn.ws.SetWriteDeadline(t)
+}
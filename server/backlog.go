@@ -0,0 +1,353 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"udr-tree/network"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Mensaje pendiente para una replica, los numeros de secuencia de cada
+// replica empiezan en 1 y son consecutivos
+type entry struct {
+	Seq  uint64
+	Data []byte
+}
+
+// Estado de una replica que se conecto alguna vez. Los mensajes se
+// guardan hasta que la replica los confirma con un Ack, se conecte o no
+type replica struct {
+	id         uint64
+	subscribed map[string]bool // documentos de la replica
+	backlog    []entry         // mensajes con Seq > acked
+	nextSeq    uint64
+	acked      uint64
+	lost       uint64  // mensajes descartados desde la ultima conexion
+	client     *client // nil si la replica no esta conectada
+	log        *segmentLog
+	// mensajes recibidos de la replica contando como ella, ver Hello.Sent.
+	// No se guarda en disco, despues de un reinicio la replica reenvia
+	// lo que no tiene confirmado y los arboles descartan los duplicados
+	accepted uint64
+	counted  bool
+	codecs   bool // entiende los mensajes Capabilities
+}
+
+func newReplica(id uint64) *replica {
+	return &replica{
+		id:         id,
+		subscribed: map[string]bool{"": true},
+		nextSeq:    1,
+	}
+}
+
+// las replicas anteriores leen Capabilities como una operacion
+func (r *replica) accepts(env network.Envelope) bool {
+	return r.codecs || env.Type != network.TypeCapabilities
+}
+
+// se llama con el lock del servidor, devuelve false si se perdieron
+// mensajes por superar max
+func (r *replica) push(data []byte, max int) bool {
+	e := entry{r.nextSeq, data}
+	r.nextSeq++
+	r.backlog = append(r.backlog, e)
+	if r.log != nil {
+		if err := r.log.append(e); err != nil {
+			log.Println("backlog of replica", r.id, err)
+		}
+	}
+
+	if max <= 0 || len(r.backlog) <= max {
+		return true
+	}
+
+	r.lost++
+	r.ack(r.backlog[len(r.backlog)-max-1].Seq)
+	return false
+}
+
+// se llama con el lock del servidor, devuelve false si ya estaba suscrita
+func (r *replica) subscribe(doc string) bool {
+	if r.subscribed[doc] {
+		return false
+	}
+
+	r.subscribed[doc] = true
+	r.saveSubscribed()
+	return true
+}
+
+// una replica sin estado vuelve a tener solo el documento por defecto
+func (r *replica) resetSubscribed() {
+	r.subscribed = map[string]bool{"": true}
+	r.saveSubscribed()
+}
+
+func (r *replica) saveSubscribed() {
+	if r.log == nil {
+		return
+	}
+
+	if err := r.log.writeSubscribed(r.subscribed); err != nil {
+		log.Println("backlog of replica", r.id, err)
+	}
+}
+
+// descarta los mensajes hasta seq
+func (r *replica) ack(seq uint64) {
+	if seq <= r.acked {
+		return
+	}
+
+	r.acked = min(seq, r.nextSeq-1)
+	i := sort.Search(len(r.backlog), func(i int) bool {
+		return r.backlog[i].Seq > r.acked
+	})
+
+	// se copia para no retener el arreglo viejo
+	r.backlog = append([]entry(nil), r.backlog[i:]...)
+	if r.log != nil {
+		if err := r.log.trim(r.acked); err != nil {
+			log.Println("backlog of replica", r.id, err)
+		}
+	}
+}
+
+// mensajes con Seq > seq
+func (r *replica) after(seq uint64) []entry {
+	i := sort.Search(len(r.backlog), func(i int) bool {
+		return r.backlog[i].Seq > seq
+	})
+
+	return r.backlog[i:len(r.backlog):len(r.backlog)]
+}
+
+// Log en disco de los mensajes pendientes de una replica. Se divide en
+// segmentos con el nombre de su primer Seq, un segmento se borra cuando
+// se confirman todos sus mensajes. El archivo acked guarda el ultimo Ack
+// y subscribed los documentos de la replica. Los segmentos se sincronizan
+// con el disco al llenarse y al cerrar el log, si el sistema se cae se
+// pueden perder los ultimos mensajes del segmento abierto
+type segmentLog struct {
+	dir      string
+	maxBytes int64
+	segments []segment
+	file     *os.File // ultimo segmento
+}
+
+type segment struct {
+	first uint64
+	last  uint64
+	size  int64
+}
+
+func segmentName(first uint64) string {
+	return fmt.Sprintf("%020d.seg", first)
+}
+
+// Abre el log de dir y devuelve los mensajes pendientes y el ultimo Ack
+func openSegmentLog(dir string, maxBytes int64) (*segmentLog, []entry, uint64, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, nil, 0, err
+	}
+
+	l := &segmentLog{dir: dir, maxBytes: maxBytes}
+	var acked uint64
+	if data, err := os.ReadFile(filepath.Join(dir, "acked")); err == nil {
+		acked, err = strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+		if err != nil {
+			return nil, nil, 0, err
+		}
+	}
+
+	names, err := filepath.Glob(filepath.Join(dir, "*.seg"))
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	sort.Strings(names)
+	var entries []entry
+	for _, name := range names {
+		seg, segEntries, err := readSegment(name)
+		if err != nil {
+			return nil, nil, 0, err
+		} else if len(segEntries) == 0 {
+			os.Remove(name)
+			continue
+		}
+
+		l.segments = append(l.segments, seg)
+		for _, e := range segEntries {
+			if e.Seq <= acked {
+				continue
+			}
+
+			// los backlogs de la version 1 guardan los mensajes sin sobre
+			if !network.IsEnvelope(e.Data) {
+				if data, err := network.Wrap(e.Data); err == nil {
+					e.Data = data
+				}
+			}
+
+			entries = append(entries, e)
+		}
+	}
+
+	return l, entries, acked, l.trim(acked)
+}
+
+// un mensaje cortado al final del segmento se descarta
+func readSegment(name string) (segment, []entry, error) {
+	var seg segment
+	f, err := os.Open(name)
+	if err != nil {
+		return seg, nil, err
+	}
+	defer f.Close()
+
+	var entries []entry
+	dec := msgpack.NewDecoder(bufio.NewReader(f))
+	for {
+		var e entry
+		if err := dec.Decode(&e); err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return seg, nil, err
+		}
+
+		entries = append(entries, e)
+	}
+
+	if len(entries) > 0 {
+		info, err := f.Stat()
+		if err != nil {
+			return seg, nil, err
+		}
+
+		seg = segment{entries[0].Seq, entries[len(entries)-1].Seq, info.Size()}
+	}
+
+	return seg, entries, nil
+}
+
+func (l *segmentLog) append(e entry) error {
+	data, err := msgpack.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	// los mensajes se agregan al ultimo segmento hasta que se llena
+	n := len(l.segments)
+	if l.file == nil || l.segments[n-1].size+int64(len(data)) > l.maxBytes {
+		if l.file != nil {
+			if err := l.file.Sync(); err != nil {
+				return err
+			}
+
+			l.file.Close()
+		}
+
+		name := filepath.Join(l.dir, segmentName(e.Seq))
+		l.file, err = os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			l.file = nil
+			return err
+		}
+
+		l.segments = append(l.segments, segment{first: e.Seq})
+		n++
+	}
+
+	if _, err := l.file.Write(data); err != nil {
+		return err
+	}
+
+	l.segments[n-1].last = e.Seq
+	l.segments[n-1].size += int64(len(data))
+	return nil
+}
+
+// borra los segmentos confirmados y guarda acked
+func (l *segmentLog) trim(acked uint64) error {
+	// el ultimo segmento sigue abierto para agregar mensajes
+	for len(l.segments) > 1 && l.segments[0].last <= acked {
+		if err := os.Remove(filepath.Join(l.dir, segmentName(l.segments[0].first))); err != nil {
+			return err
+		}
+
+		l.segments = l.segments[1:]
+	}
+
+	tmp := filepath.Join(l.dir, "acked.tmp")
+	if err := os.WriteFile(tmp, []byte(strconv.FormatUint(acked, 10)+"\n"), 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, filepath.Join(l.dir, "acked"))
+}
+
+func (l *segmentLog) close() {
+	if l.file != nil {
+		if err := l.file.Sync(); err != nil {
+			log.Println("backlog:", err)
+		}
+
+		l.file.Close()
+	}
+}
+
+// documentos guardados con writeSubscribed, nil si no hay
+func (l *segmentLog) readSubscribed() (map[string]bool, error) {
+	data, err := os.ReadFile(filepath.Join(l.dir, "subscribed"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var docs []string
+	if err := msgpack.Unmarshal(data, &docs); err != nil {
+		return nil, err
+	}
+
+	subscribed := make(map[string]bool)
+	for _, doc := range docs {
+		subscribed[doc] = true
+	}
+
+	return subscribed, nil
+}
+
+func (l *segmentLog) writeSubscribed(subscribed map[string]bool) error {
+	var docs []string
+	for doc := range subscribed {
+		docs = append(docs, doc)
+	}
+
+	data, err := msgpack.Marshal(docs)
+	if err != nil {
+		return err
+	}
+
+	tmp := filepath.Join(l.dir, "subscribed.tmp")
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, filepath.Join(l.dir, "subscribed"))
+}
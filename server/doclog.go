@@ -0,0 +1,139 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package server
+
+import (
+	"log"
+	"udr-tree/network"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Log de un documento para las replicas que se unen tarde: el ultimo
+// estado recibido de una replica y las operaciones que no incluye. Los
+// mensajes se guardan en su sobre, el servidor no lee Payload salvo en
+// los estados
+type docLog struct {
+	snapshot []byte // mensaje network.Snapshot, nil si no hay estado
+	entries  []logEntry
+	nextPos  uint64
+	// pedido de estado pendiente, ver requestSnapshot
+	requested  *replica
+	requestPos uint64
+}
+
+type logEntry struct {
+	pos  uint64
+	from uint64
+	data []byte
+}
+
+// se llama con el lock tomado
+func (server *Server) doc(name string) *docLog {
+	d, ok := server.docs[name]
+	if !ok {
+		d = &docLog{nextPos: 1}
+		server.docs[name] = d
+	}
+
+	return d
+}
+
+// Envia el estado y las operaciones posteriores del documento a una
+// replica sin estado. Las replicas sin handshake no entienden los estados
+func (server *Server) join(c *client, name string) {
+	if c.legacy {
+		return
+	}
+
+	d := server.doc(name)
+	if d.snapshot != nil {
+		server.deliver(c.replica, d.snapshot)
+	}
+
+	for _, e := range d.entries {
+		if env, err := network.ReadEnvelope(e.data); err == nil && c.replica.accepts(env) {
+			server.deliver(c.replica, e.data)
+		}
+	}
+}
+
+// Si hay un estado guardado del documento y cuantas operaciones le siguen
+func (server *Server) DocumentLog(name string) (bool, int) {
+	server.Lock()
+	defer server.Unlock()
+
+	d := server.doc(name)
+	return d.snapshot != nil, len(d.entries)
+}
+
+func (server *Server) appendLog(from *client, name string, data []byte) {
+	d := server.doc(name)
+	d.entries = append(d.entries, logEntry{d.nextPos, from.replica.id, data})
+	d.nextPos++
+	if server.config.SnapshotEvery > 0 && d.requested == nil &&
+		len(d.entries) >= server.config.SnapshotEvery {
+		server.requestSnapshot(name, d)
+	}
+}
+
+// Se pide el estado a la replica conectada con menor ID. El pedido va
+// en orden con los demas mensajes de la replica, asi su estado incluye
+// las operaciones de las demas replicas hasta requestPos y sus propias
+// operaciones hasta que llega la respuesta
+func (server *Server) requestSnapshot(name string, d *docLog) {
+	var target *replica
+	for _, r := range server.replicas {
+		if r.client != nil && !r.client.legacy && r.subscribed[name] &&
+			(target == nil || r.id < target.id) {
+			target = r
+		}
+	}
+
+	if target == nil {
+		return
+	}
+
+	d.requested = target
+	d.requestPos = d.nextPos - 1
+	server.deliver(target, network.SyncRequestMessage(name))
+}
+
+// data es el sobre de env, se guarda entero
+func (server *Server) receiveSnapshot(from *client, env network.Envelope, data []byte) {
+	d := server.doc(env.Document)
+	var snapshot network.Snapshot
+	if err := msgpack.Unmarshal(env.Payload, &snapshot); err != nil {
+		log.Println("Invalid snapshot from replica", from.replica.id)
+		return
+	} else if d.requested != from.replica {
+		log.Println("Unexpected snapshot from replica", from.replica.id)
+		return
+	}
+
+	// se podan las operaciones que incluye el estado
+	var entries []logEntry
+	for _, e := range d.entries {
+		if e.pos > d.requestPos && e.from != from.replica.id {
+			entries = append(entries, e)
+		}
+	}
+
+	d.snapshot = data
+	d.entries = entries
+	d.requested = nil
+}
+
+// se llama con el lock tomado cuando la replica se desconecta o pierde
+// su estado, los pedidos se repiten con la proxima operacion
+func (server *Server) cancelRequests(r *replica) {
+	for _, d := range server.docs {
+		if d.requested == r {
+			d.requested = nil
+		}
+	}
+}
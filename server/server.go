@@ -0,0 +1,630 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"udr-tree/network"
+
+	"github.com/gorilla/websocket"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+type Config struct {
+	MaxReplicas int // IDs validos de 0 a MaxReplicas-1
+	// Mensajes guardados por replica hasta que los confirma. Si se
+	// supera se descartan los mas viejos y la replica pierde mensajes
+	BacklogSize int
+	// Si no es vacio los mensajes pendientes tambien se guardan en disco
+	// y sobreviven a un reinicio del servidor
+	BacklogDir   string
+	SegmentBytes int64 // tamaño de cada segmento del log en disco
+	// Operaciones de un documento despues de las cuales se pide su estado
+	// a una replica, con 0 no se piden estados y el log no se poda
+	SnapshotEvery int
+	// Origenes de las paginas web que se pueden conectar por WebSocket,
+	// "*" acepta cualquiera. Siempre se aceptan los clientes sin Origin y
+	// las paginas servidas por el mismo host
+	AllowedOrigins []string
+}
+
+var DefaultConfig = Config{
+	MaxReplicas:   10,
+	BacklogSize:   100000,
+	SegmentBytes:  4 << 20,
+	SnapshotEvery: 1000,
+}
+
+// Servidor que reenvia los mensajes de cada replica a las demas replicas
+// suscritas al mismo documento. Los mensajes se guardan por replica en
+// orden bajo el lock del servidor, asi cada replica los recibe en orden
+// causal aunque haya estado desconectada
+type Server struct {
+	sync.Mutex
+	config   Config
+	replicas map[uint64]*replica
+	docs     map[string]*docLog
+	ln       net.Listener
+	web      *http.Server // endpoint WebSocket de ListenAndServeWebSocket
+	closed   bool
+	wg       sync.WaitGroup
+}
+
+// Conexion de una replica
+type client struct {
+	replica *replica
+	conn    net.Conn
+	legacy  bool          // sin handshake, no manda Ack
+	version uint32        // version 1 o sin handshake: mensajes sin sobre
+	sent    uint64        // ultimo Seq enviado
+	notify  chan struct{} // hay mensajes nuevos
+	done    chan struct{}
+	// la replica manda heartbeats, se responden fuera del backlog
+	heartbeats bool
+	heartbeat  chan struct{}
+	// la replica recibe Accepted en respuesta a cada Ack
+	accepting bool
+	accepted  chan struct{}
+}
+
+// Carga los mensajes pendientes de config.BacklogDir si existe
+func New(config Config) (*Server, error) {
+	server := &Server{
+		config:   config,
+		replicas: make(map[uint64]*replica),
+		docs:     make(map[string]*docLog),
+	}
+
+	if config.BacklogDir == "" {
+		return server, nil
+	}
+
+	dirs, err := os.ReadDir(config.BacklogDir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	for _, dir := range dirs {
+		id, err := strconv.ParseUint(dir.Name(), 10, 64)
+		if err != nil || !dir.IsDir() {
+			continue
+		}
+
+		if _, err := server.replica(id); err != nil {
+			return nil, err
+		}
+	}
+
+	return server, nil
+}
+
+// se llama con el lock tomado, crea el estado de la replica si no existe
+func (server *Server) replica(id uint64) (*replica, error) {
+	if r, ok := server.replicas[id]; ok {
+		return r, nil
+	}
+
+	r := newReplica(id)
+	if server.config.BacklogDir != "" {
+		dir := filepath.Join(server.config.BacklogDir, strconv.FormatUint(id, 10))
+		l, entries, acked, err := openSegmentLog(dir, server.config.SegmentBytes)
+		if err != nil {
+			return nil, err
+		}
+
+		subscribed, err := l.readSubscribed()
+		if err != nil {
+			return nil, err
+		} else if subscribed != nil {
+			r.subscribed = subscribed
+		}
+
+		r.log = l
+		r.backlog = entries
+		r.acked = acked
+		r.nextSeq = acked + 1
+		if len(entries) > 0 {
+			r.nextSeq = entries[len(entries)-1].Seq + 1
+		}
+	}
+
+	server.replicas[id] = r
+	return r, nil
+}
+
+func (server *Server) ListenAndServe(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	return server.Serve(ln)
+}
+
+// Acepta conexiones hasta que se llama a Close
+func (server *Server) Serve(ln net.Listener) error {
+	server.Lock()
+	server.ln = ln
+	server.Unlock()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			server.Lock()
+			closed := server.closed
+			server.Unlock()
+			if closed {
+				return nil
+			}
+
+			return err
+		}
+
+		server.wg.Add(1)
+		go server.handleConnection(conn)
+	}
+}
+
+// Endpoint WebSocket, cada mensaje binario lleva un mensaje msgpack igual
+// que en las conexiones TCP
+func (server *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	server.Lock()
+	closed := server.closed
+	if !closed {
+		server.wg.Add(1)
+	}
+	server.Unlock()
+	if closed {
+		http.Error(w, "server closed", http.StatusServiceUnavailable)
+		return
+	}
+
+	upgrader := websocket.Upgrader{CheckOrigin: server.checkOrigin}
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		server.wg.Done()
+		return
+	}
+
+	server.handleConnection(network.NewWebSocketConn(ws))
+}
+
+// Las paginas de otros sitios no pueden usar el servidor con la sesion
+// del navegador, solo las de config.AllowedOrigins
+func (server *Server) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	for _, allowed := range server.config.AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+// Atiende el endpoint WebSocket en addr hasta que se llama a Close
+func (server *Server) ListenAndServeWebSocket(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle(network.WebSocketPath, server)
+	server.Lock()
+	if server.closed {
+		server.Unlock()
+		return nil
+	}
+
+	web := &http.Server{Addr: addr, Handler: mux}
+	server.web = web
+	server.Unlock()
+	if err := web.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+
+	return nil
+}
+
+// Cierra el listener, todas las conexiones y los logs en disco
+func (server *Server) Close() {
+	server.Lock()
+	server.closed = true
+	if server.ln != nil {
+		server.ln.Close()
+	}
+
+	if server.web != nil {
+		server.web.Close()
+	}
+
+	for _, r := range server.replicas {
+		if r.client != nil {
+			r.client.conn.Close()
+		}
+	}
+	server.Unlock()
+	server.wg.Wait()
+
+	for _, r := range server.replicas {
+		if r.log != nil {
+			r.log.close()
+		}
+	}
+}
+
+// IDs de las replicas conectadas
+func (server *Server) Replicas() []uint64 {
+	server.Lock()
+	defer server.Unlock()
+
+	var ids []uint64
+	for id, r := range server.replicas {
+		if r.client != nil {
+			ids = append(ids, id)
+		}
+	}
+
+	return ids
+}
+
+// Cantidad de mensajes guardados para la replica id
+func (server *Server) Backlog(id uint64) int {
+	server.Lock()
+	defer server.Unlock()
+
+	if r, ok := server.replicas[id]; ok {
+		return len(r.backlog)
+	}
+
+	return 0
+}
+
+func (server *Server) handleConnection(conn net.Conn) {
+	defer server.wg.Done()
+	defer conn.Close()
+
+	dec := msgpack.NewDecoder(conn)
+	data, err := dec.DecodeRaw()
+	if err != nil {
+		return
+	}
+
+	var hello network.Hello
+	if msgpack.Unmarshal(data, &hello) != nil || !hello.Hello {
+		// replica sin handshake, se le asigna un ID libre
+		hello = network.Hello{Assign: true}
+	} else {
+		data = nil
+	}
+
+	c, err := server.register(conn, hello)
+	if hello.Hello {
+		reply := network.Hello{Hello: true, Version: network.ProtocolVersion}
+		if err != nil {
+			reply.Error = err.Error()
+		} else {
+			reply.ReplicaID = c.replica.id
+			reply.Received = c.sent
+			reply.Accepted = c.replica.accepted
+			for _, feature := range network.Features {
+				if hello.Supports(feature) {
+					reply.Features = append(reply.Features, feature)
+				}
+			}
+		}
+
+		if payload, err := msgpack.Marshal(reply); err == nil {
+			conn.Write(payload)
+		}
+	}
+
+	if err != nil {
+		log.Println("Rejected replica:", err)
+		return
+	}
+
+	log.Println("Connected replica", c.replica.id)
+	server.wg.Add(1)
+	go server.writeLoop(c)
+	if data != nil {
+		server.route(c, data)
+	}
+
+	for {
+		// una replica con heartbeats que no manda nada se da por perdida
+		if c.heartbeats {
+			conn.SetReadDeadline(time.Now().Add(network.HeartbeatTimeout))
+		}
+
+		data, err := dec.DecodeRaw()
+		if err != nil {
+			break
+		}
+
+		server.route(c, data)
+	}
+
+	server.unregister(c)
+	log.Println("Disconnected replica", c.replica.id)
+}
+
+func (server *Server) register(conn net.Conn, hello network.Hello) (*client, error) {
+	server.Lock()
+	defer server.Unlock()
+
+	if hello.Version > network.ProtocolVersion {
+		return nil, fmt.Errorf("unsupported protocol version %d", hello.Version)
+	}
+
+	id := hello.ReplicaID
+	if hello.Assign {
+		for id = 0; id < uint64(server.config.MaxReplicas); id++ {
+			if r, ok := server.replicas[id]; !ok || r.client == nil {
+				break
+			}
+		}
+	}
+
+	idStr := strconv.FormatUint(id, 10)
+	if id >= uint64(server.config.MaxReplicas) {
+		if hello.Assign {
+			return nil, errors.New("no free replica id")
+		}
+
+		return nil, errors.New("invalid replica id " + idStr)
+	}
+
+	_, known := server.replicas[id]
+	r, err := server.replica(id)
+	if err != nil {
+		return nil, err
+	} else if r.client != nil {
+		return nil, errors.New("replica " + idStr + " is already connected")
+	}
+
+	if r.lost > 0 && !hello.Join {
+		log.Println("Replica", idStr, "lost", r.lost, "messages")
+	}
+
+	// lo que la replica ya recibio no se vuelve a enviar, una replica
+	// sin estado recibe todo de nuevo con join
+	r.lost = 0
+	r.ack(hello.Received)
+	// una replica sin estado empieza a contar de nuevo
+	if hello.Join || !r.counted {
+		r.accepted = hello.Sent
+		r.counted = true
+	} else {
+		r.accepted = max(r.accepted, hello.Sent)
+	}
+
+	r.codecs = hello.Supports(network.FeatureCodecs)
+	if hello.Join {
+		r.ack(r.nextSeq - 1)
+		r.resetSubscribed()
+		server.cancelRequests(r)
+	}
+
+	c := &client{
+		replica:    r,
+		conn:       conn,
+		legacy:     !hello.Hello,
+		version:    max(hello.Version, 1),
+		sent:       r.acked,
+		notify:     make(chan struct{}, 1),
+		done:       make(chan struct{}),
+		heartbeats: hello.Supports(network.FeatureHeartbeat),
+		heartbeat:  make(chan struct{}, 1),
+		accepting:  hello.Supports(network.FeatureAccepted),
+		accepted:   make(chan struct{}, 1),
+	}
+
+	r.client = c
+	if hello.Join {
+		server.join(c, "")
+	} else if !known && hello.Resume {
+		// el servidor se reinicio sin backlog, la replica recibe el log
+		// del documento y descarta lo que ya tiene
+		log.Println("Replica", idStr, "reconnected after a restart, sending the document log")
+		server.join(c, "")
+	}
+
+	// documentos abiertos por la replica, ver Hello.Documents
+	for _, doc := range hello.Documents {
+		if r.subscribe(doc) {
+			server.join(c, doc)
+		}
+	}
+
+	// el backlog que quedo pendiente se envia al conectarse
+	select {
+	case c.notify <- struct{}{}:
+	default:
+	}
+
+	return c, nil
+}
+
+func (server *Server) unregister(c *client) {
+	server.Lock()
+	defer server.Unlock()
+
+	if c.replica.client == c {
+		c.replica.client = nil
+		close(c.done)
+		server.cancelRequests(c.replica)
+	}
+}
+
+// se escribe en una goroutine por replica, una replica lenta no frena
+// el envio a las demas
+func (server *Server) writeLoop(c *client) {
+	defer server.wg.Done()
+	for {
+		select {
+		case <-c.notify:
+		case <-c.heartbeat:
+			if _, err := c.conn.Write(c.wire(network.HeartbeatMessage())); err != nil {
+				c.conn.Close()
+				return
+			}
+
+			continue
+		case <-c.accepted:
+			server.Lock()
+			accepted := c.replica.accepted
+			server.Unlock()
+			if _, err := c.conn.Write(c.wire(network.AcceptedMessage(accepted))); err != nil {
+				c.conn.Close()
+				return
+			}
+
+			continue
+		case <-c.done:
+			return
+		}
+
+		server.Lock()
+		entries := c.replica.after(c.sent)
+		server.Unlock()
+		for _, e := range entries {
+			if _, err := c.conn.Write(c.wire(e.Data)); err != nil {
+				c.conn.Close()
+				return
+			}
+		}
+
+		if len(entries) == 0 {
+			continue
+		}
+
+		server.Lock()
+		c.sent = entries[len(entries)-1].Seq
+		// las replicas sin handshake no confirman los mensajes
+		if c.legacy {
+			c.replica.ack(c.sent)
+		}
+		server.Unlock()
+	}
+}
+
+// Los mensajes se guardan en sobre, a las replicas de la version 1 se
+// les envia el mensaje sin sobre
+func (c *client) wire(data []byte) []byte {
+	if c.version >= 2 {
+		return data
+	}
+
+	env, _ := network.ReadEnvelope(data)
+	return env.Payload
+}
+
+// Los mensajes de las replicas de la version 1 se ponen en un sobre
+// segun sus campos
+func (server *Server) route(from *client, data []byte) {
+	var err error
+	if from.version < 2 {
+		data, err = network.Wrap(data)
+	}
+
+	var env network.Envelope
+	if err == nil {
+		env, err = network.ReadEnvelope(data)
+	}
+
+	if err != nil {
+		log.Println("Invalid message from replica", from.replica.id)
+		return
+	}
+
+	server.Lock()
+	defer server.Unlock()
+
+	switch env.Type {
+	case network.TypeSubscribe:
+		// la replica repite las suscripciones en cada conexion
+		if from.replica.subscribe(env.Document) {
+			server.join(from, env.Document)
+		}
+
+		return
+	case network.TypeAck:
+		var ack network.Ack
+		if msgpack.Unmarshal(env.Payload, &ack) == nil && ack.Received <= from.sent {
+			from.replica.ack(ack.Received)
+		}
+
+		if from.accepting {
+			select {
+			case from.accepted <- struct{}{}:
+			default:
+			}
+		}
+
+		return
+	case network.TypeHeartbeat:
+		select {
+		case from.heartbeat <- struct{}{}:
+		default:
+		}
+
+		return
+	case network.TypeHello:
+		log.Println("Unexpected hello from replica", from.replica.id)
+		return
+	}
+
+	from.replica.accepted++
+	switch env.Type {
+	case network.TypeSyncRequest:
+		// la replica descarto un mensaje invalido y pide el log de nuevo
+		log.Println("Replica", from.replica.id, "requested the log of document", env.Document)
+		server.join(from, env.Document)
+		return
+	case network.TypeSnapshot:
+		server.receiveSnapshot(from, env, data)
+		return
+	}
+
+	for id, r := range server.replicas {
+		if id != from.replica.id && r.subscribed[env.Document] && r.accepts(env) {
+			server.deliver(r, data)
+		}
+	}
+
+	server.appendLog(from, env.Document, data)
+}
+
+// se llama con el lock tomado
+func (server *Server) deliver(r *replica, data []byte) {
+	if !r.push(data, server.config.BacklogSize) && r.lost == 1 {
+		log.Println("Backlog of replica", r.id, "is full, dropping old messages")
+		// la replica ya no puede recibir los mensajes en orden
+		if r.client != nil {
+			r.client.conn.Close()
+		}
+	}
+
+	if r.client != nil {
+		select {
+		case r.client.notify <- struct{}{}:
+		default:
+		}
+	}
+}
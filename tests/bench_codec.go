@@ -0,0 +1,105 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package main
+
+import (
+	"errors"
+	"log"
+	"math/rand"
+	"os"
+	"strconv"
+	"time"
+	"udr-tree/crdt"
+
+	"github.com/google/uuid"
+)
+
+// Compara el tamaño y la velocidad de MessagePack y del codec compacto
+// con operaciones parecidas a las de test_stress
+func main() {
+	if len(os.Args) != 2 {
+		log.Fatal(errors.New("USE: ./bench_codec [ops]"))
+	}
+
+	n, err := strconv.Atoi(os.Args[1])
+	if err != nil {
+		panic(err)
+	}
+
+	nodes := []uuid.UUID{uuid.New()}
+	ops := make([]crdt.Operation, n)
+	for i := range ops {
+		// un tercio de operaciones crea nodos, el resto los mueve
+		node := nodes[rand.Intn(len(nodes))]
+		name := ""
+		if i%3 == 0 {
+			node = uuid.New()
+			nodes = append(nodes, node)
+			name = node.String()
+		}
+
+		ops[i] = crdt.Operation{
+			ReplicaID: uint64(i % crdt.NumReplicas),
+			Timestamp: uint64(i + 1),
+			NewParent: nodes[rand.Intn(len(nodes))],
+			Node:      node,
+			Name:      name,
+		}
+	}
+
+	start := time.Now()
+	var msgpackData [][]byte
+	msgpackSize := 0
+	for _, op := range ops {
+		data := crdt.OperationToBytes(op)
+		msgpackData = append(msgpackData, data)
+		msgpackSize += len(data)
+	}
+	msgpackEnc := time.Since(start)
+
+	start = time.Now()
+	for _, data := range msgpackData {
+		crdt.OperationFromBytes(data)
+	}
+	msgpackDec := time.Since(start)
+
+	// cada replica tiene su codec, el receptor tiene otro
+	var encoders [crdt.NumReplicas]*crdt.CompactCodec
+	for i := range encoders {
+		encoders[i] = crdt.NewCompactCodec()
+	}
+
+	start = time.Now()
+	var compactData [][]byte
+	compactSize := 0
+	for _, op := range ops {
+		data := encoders[op.ReplicaID].Encode(op)
+		compactData = append(compactData, data)
+		compactSize += len(data)
+	}
+	compactEnc := time.Since(start)
+
+	decoder := crdt.NewCompactCodec()
+	start = time.Now()
+	for i, data := range compactData {
+		op, err := decoder.Decode(data)
+		if err != nil {
+			log.Fatal(err)
+		} else if op.Node != ops[i].Node || op.NewParent != ops[i].NewParent {
+			log.Fatal(errors.New("compact codec returned a different operation"))
+		}
+	}
+	compactDec := time.Since(start)
+
+	log.Println("\n\tOperations:", n,
+		"\n\tMessagePack avg size:", msgpackSize/n, "bytes",
+		"\n\tMessagePack encode:", msgpackEnc/time.Duration(n), "per operation",
+		"\n\tMessagePack decode:", msgpackDec/time.Duration(n), "per operation",
+		"\n\tCompact avg size:", compactSize/n, "bytes",
+		"\n\tCompact encode:", compactEnc/time.Duration(n), "per operation",
+		"\n\tCompact decode:", compactDec/time.Duration(n), "per operation")
+}
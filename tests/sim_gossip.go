@@ -0,0 +1,126 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+	"udr-tree/network"
+)
+
+// Replica que solo cuenta las operaciones que recibe, el arbol admite
+// pocas replicas y aca interesa la propagacion
+type counter struct {
+	sync.Mutex
+	id       int
+	received int
+}
+
+func (c *counter) GetID() int {
+	return c.id
+}
+
+func (c *counter) ApplyRemoteOperation(data []byte) {
+	c.ApplyRemoteOperations([][]byte{data})
+}
+
+func (c *counter) ApplyRemoteOperations(packets [][]byte) {
+	c.Lock()
+	defer c.Unlock()
+	c.received += len(packets)
+}
+
+func (c *counter) count() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.received
+}
+
+// Mide cuanto tardan en llegar a todas las replicas las operaciones
+// enviadas por gossip
+func main() {
+	replicas := flag.Int("replicas", 20, "number of replicas")
+	ops := flag.Int("ops", 10, "operations sent by each replica")
+	fanout := flag.Int("fanout", network.DefaultGossipConfig.Fanout, "peers contacted in each round")
+	interval := flag.Duration("interval", network.DefaultGossipConfig.Interval, "time between rounds")
+	timeout := flag.Duration("timeout", time.Minute, "give up after this time")
+	port := flag.Int("port", 21000, "port of the first replica, the others use the next ones")
+	flag.Parse()
+
+	// puertos fijos, los libres del sistema se usan para las conexiones
+	addrs := make([]string, *replicas)
+	for i := range addrs {
+		addrs[i] = net.JoinHostPort("localhost", fmt.Sprint(*port+i))
+	}
+
+	config := network.GossipConfig{Fanout: *fanout, Interval: *interval}
+	counters := make([]*counter, *replicas)
+	conns := make([]*network.GossipConn, *replicas)
+	for i := range conns {
+		var peers []string
+		for j, addr := range addrs {
+			if j != i {
+				peers = append(peers, addr)
+			}
+		}
+
+		counters[i] = &counter{id: i}
+		conns[i] = network.NewGossipConn(counters[i], addrs[i], peers, config)
+	}
+
+	start := time.Now()
+	for i := 0; i < *ops; i++ {
+		for _, conn := range conns {
+			conn.Send([]byte(fmt.Sprint("op", i)))
+		}
+	}
+
+	// cada replica recibe las operaciones de las demas
+	want := (*replicas - 1) * *ops
+	half := time.Duration(0)
+	for {
+		done := 0
+		for _, c := range counters {
+			if c.count() == want {
+				done++
+			}
+		}
+
+		if half == 0 && 2*done >= *replicas {
+			half = time.Since(start)
+		}
+
+		if done == *replicas {
+			break
+		} else if time.Since(start) > *timeout {
+			fmt.Println("Not converged,", done, "of", *replicas, "replicas have all operations")
+			return
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	elapsed := time.Since(start)
+	fmt.Printf("Replicas: %d, fanout: %d, interval: %v\n", *replicas, *fanout, *interval)
+	fmt.Printf("Half of the replicas converged in %v (%.1f rounds)\n", half, float64(half)/float64(*interval))
+	fmt.Printf("All replicas converged in %v (%.1f rounds)\n", elapsed, float64(elapsed)/float64(*interval))
+
+	// despues de unas rondas todos los peers conocen todas las operaciones
+	time.Sleep(10 * *interval)
+	stored := 0
+	for _, conn := range conns {
+		stored = max(stored, conn.Stored())
+	}
+
+	fmt.Printf("Operations still stored by a replica: %d of %d\n", stored, *replicas**ops)
+	for _, conn := range conns {
+		conn.Close()
+	}
+}
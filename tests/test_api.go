@@ -0,0 +1,141 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"time"
+	"udr-tree/api"
+	"udr-tree/crdt"
+	"udr-tree/network"
+)
+
+// Prueba la API HTTP y los eventos con una replica sin peers
+func main() {
+	tree := crdt.NewTreeWithConn(0, func(tree network.CRDTTree) network.ReplicaConn {
+		return network.NewMeshConn(tree, "localhost:0", nil)
+	})
+	defer tree.Close()
+
+	web := httptest.NewServer(api.New(tree))
+	defer web.Close()
+
+	stream, err := http.Get(web.URL + "/events")
+	if err != nil {
+		panic(err)
+	}
+	defer stream.Body.Close()
+
+	kinds := make(chan crdt.EventKind, 100)
+	go func() {
+		scanner := bufio.NewScanner(stream.Body)
+		for scanner.Scan() {
+			var event crdt.Event
+			if data, ok := strings.CutPrefix(scanner.Text(), "data: "); ok && json.Unmarshal([]byte(data), &event) == nil {
+				kinds <- event.Kind
+			}
+		}
+	}()
+
+	steps := []struct {
+		method string
+		path   string
+		body   string
+		status int
+	}{
+		{"POST", "/add", `{"name": "a", "parent": "root"}`, http.StatusOK},
+		{"POST", "/add", `{"name": "b", "parent": "a"}`, http.StatusOK},
+		{"POST", "/add", `{"name": "c", "parent": "root"}`, http.StatusOK},
+		{"POST", "/add", `{"name": "a", "parent": "root"}`, http.StatusConflict},
+		{"POST", "/mv", `{"node": "c", "parent": "b"}`, http.StatusOK},
+		{"POST", "/mv", `{"node": "a", "parent": "c"}`, http.StatusConflict},
+		{"POST", "/add", `{"name": "d", "parent": "root"}`, http.StatusOK},
+		{"POST", "/rm", `{"node": "d"}`, http.StatusOK},
+		{"POST", "/rm", `not json`, http.StatusBadRequest},
+		{"GET", "/tree?node=missing", "", http.StatusNotFound},
+		{"GET", "/stats", "", http.StatusOK},
+		{"GET", "/", "", http.StatusOK},
+		{"DELETE", "/stats", "", http.StatusMethodNotAllowed},
+	}
+
+	failed := false
+	var last struct{ Time uint64 }
+	for _, step := range steps {
+		req, _ := http.NewRequest(step.method, web.URL+step.path, bytes.NewBufferString(step.body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			panic(err)
+		}
+
+		// el tiempo de cada operacion es el de la operacion aplicada
+		if step.method == "POST" && resp.StatusCode == http.StatusOK {
+			json.NewDecoder(resp.Body).Decode(&last)
+		}
+
+		resp.Body.Close()
+		if resp.StatusCode != step.status {
+			fmt.Println("FAIL:", step.method, step.path, step.body+": status", resp.StatusCode)
+			failed = true
+		}
+	}
+
+	var subtree struct {
+		Name     string
+		Children []struct {
+			Name     string
+			Children []struct{ Name string }
+		}
+	}
+
+	resp, err := http.Get(web.URL + "/tree?node=a")
+	if err != nil {
+		panic(err)
+	}
+	json.NewDecoder(resp.Body).Decode(&subtree)
+	resp.Body.Close()
+	if subtree.Name != "a" || len(subtree.Children) != 1 || len(subtree.Children[0].Children) != 1 {
+		fmt.Println("FAIL: subtree of a:", subtree)
+		failed = true
+	}
+
+	var stats crdt.Stats
+	resp, _ = http.Get(web.URL + "/stats")
+	json.NewDecoder(resp.Body).Decode(&stats)
+	resp.Body.Close()
+	if stats.Nodes != 4 || stats.LocalOps != 6 || stats.Time != last.Time {
+		fmt.Println("FAIL: stats:", stats)
+		failed = true
+	}
+
+	// un evento por operacion aceptada, en orden
+	want := []crdt.EventKind{crdt.EventAdd, crdt.EventAdd, crdt.EventAdd, crdt.EventMove, crdt.EventAdd, crdt.EventRemove}
+	for _, kind := range want {
+		select {
+		case got := <-kinds:
+			if got != kind {
+				fmt.Println("FAIL: event", got, "instead of", kind)
+				failed = true
+			}
+		case <-time.After(time.Second):
+			fmt.Println("FAIL: missing event", kind)
+			failed = true
+		}
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+
+	fmt.Println("OK: api and events")
+}
@@ -0,0 +1,14 @@
+#!/bin/sh
+echo "API TEST"
+echo "Compiling test..."
+if ! go build ./test_api.go; then
+	echo "Compilation error"
+	exit 1
+fi
+
+if ! ./test_api.exe 2> /dev/null; then
+	echo "ERROR: API test failed"
+	exit 1
+fi
+
+echo "OK: Test passed"
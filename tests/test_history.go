@@ -0,0 +1,331 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package main
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+	"udr-tree/crdt"
+	"udr-tree/network"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Conexion que entrega cada operacion a los demas arboles del proceso
+type busConn struct {
+	bus *bus
+	id  int
+}
+
+type bus struct {
+	sync.Mutex
+	trees []*crdt.Tree
+	// las operaciones de las replicas retenidas se entregan con release
+	held    map[int]bool
+	pending map[int][][]byte
+}
+
+func (conn *busConn) Send(data []byte) {
+	conn.bus.Lock()
+	trees := conn.bus.trees
+	if conn.bus.held[conn.id] {
+		conn.bus.pending[conn.id] = append(conn.bus.pending[conn.id], data)
+		conn.bus.Unlock()
+		return
+	}
+	conn.bus.Unlock()
+
+	for i, tree := range trees {
+		if i != conn.id {
+			tree.ApplyRemoteOperation(data)
+		}
+	}
+}
+
+func (b *bus) hold(id int) {
+	b.Lock()
+	defer b.Unlock()
+	b.held[id] = true
+}
+
+func (b *bus) release(id int) {
+	b.Lock()
+	pending := b.pending[id]
+	delete(b.held, id)
+	delete(b.pending, id)
+	b.Unlock()
+
+	conn := &busConn{b, id}
+	for _, data := range pending {
+		conn.Send(data)
+	}
+}
+
+func (conn *busConn) Connect()    {}
+func (conn *busConn) Disconnect() {}
+func (conn *busConn) Close()      {}
+
+// Prueba el historial de los arboles con replicas en el mismo proceso
+func main() {
+	tests := []struct {
+		name string
+		run  func(trees []*crdt.Tree, conns *bus) error
+	}{
+		{"asof between checkpoints", testCheckpoints},
+		{"diff", testDiff},
+		{"values", testValues},
+		{"values without permission", testValueOwners},
+		{"signed tree rejects snapshots", testSignedSnapshot},
+		{"late operation before a rename", testLateRename},
+	}
+
+	failed := false
+	for _, test := range tests {
+		conns := start()
+		if err := test.run(conns.trees, conns); err != nil {
+			fmt.Println("FAIL:", test.name+":", err)
+			failed = true
+		} else {
+			fmt.Println("OK:", test.name)
+		}
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
+
+func start() *bus {
+	b := &bus{held: make(map[int]bool), pending: make(map[int][][]byte)}
+	trees := make([]*crdt.Tree, crdt.NumReplicas)
+	var wg sync.WaitGroup
+	for i := range trees {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			trees[i] = crdt.NewTreeWithConn(i, func(network.CRDTTree) network.ReplicaConn {
+				return &busConn{b, i}
+			})
+		}()
+	}
+
+	wg.Wait()
+	b.Lock()
+	b.trees = trees
+	b.Unlock()
+	return b
+}
+
+func sorted(names []string) []string {
+	sort.Strings(names)
+	return names
+}
+
+// cada replica hace una operacion para que se pueda truncar el historial
+// hasta ahora, y se espera al truncado
+func truncate(trees []*crdt.Tree, prefix string) {
+	for i, tree := range trees {
+		tree.Add(fmt.Sprint(prefix, i), "root")
+	}
+
+	time.Sleep(11 * time.Second)
+}
+
+func testCheckpoints(trees []*crdt.Tree, _ *bus) error {
+	a := trees[0]
+	a.EnableCheckpoints(5)
+	a.Add("x", "root")
+	a.Add("y", "root")
+	truncate(trees, "first")
+
+	a.Move("y", "x")
+	a.Add("z", "y")
+	at := a.Time()
+	want := sorted(a.GetNames())
+	a.Remove("x")
+	truncate(trees, "second")
+	truncate(trees, "third")
+
+	view, err := a.AsOf(at)
+	if err != nil {
+		return err
+	} else if got := sorted(view.GetNames()); !reflect.DeepEqual(got, want) {
+		return fmt.Errorf("names at %d are %v, expected %v", at, got, want)
+	}
+
+	// el fork no tiene los checkpoints
+	if _, err := a.Fork().AsOf(at); err == nil {
+		return fmt.Errorf("fork has the truncated history")
+	}
+
+	return nil
+}
+
+func testDiff(trees []*crdt.Tree, _ *bus) error {
+	a := trees[0]
+	a.Add("p", "root")
+	t1 := a.Time()
+	a.Add("q", "root")
+	a.Move("p", "q")
+	t2 := a.Time()
+
+	kinds := func(changes []crdt.Change) map[string]crdt.ChangeKind {
+		got := make(map[string]crdt.ChangeKind)
+		for _, change := range changes {
+			got[change.Name] = change.Kind
+		}
+
+		return got
+	}
+
+	forward, err := a.Diff(t1, t2)
+	if err != nil {
+		return err
+	} else if got := kinds(forward); !reflect.DeepEqual(got, map[string]crdt.ChangeKind{"q": crdt.Created, "p": crdt.Moved}) {
+		return fmt.Errorf("forward diff %v", got)
+	}
+
+	backward, err := a.Diff(t2, t1)
+	if err != nil {
+		return err
+	} else if got := kinds(backward); !reflect.DeepEqual(got, map[string]crdt.ChangeKind{"q": crdt.Removed, "p": crdt.Moved}) {
+		return fmt.Errorf("backward diff %v", got)
+	}
+
+	return nil
+}
+
+func testValues(trees []*crdt.Tree, _ *bus) error {
+	a := crdt.Typed[string](trees[0])
+	b := crdt.Typed[string](trees[1])
+	if err := a.Add("v", "root", "first"); err != nil {
+		return err
+	}
+
+	t1 := a.Time()
+	if err := b.Set("v", "second"); err != nil {
+		return err
+	}
+
+	t2 := a.Time()
+	if got, err := a.Get("v"); err != nil || got != "second" {
+		return fmt.Errorf("value %q %v", got, err)
+	}
+
+	view, err := a.AsOf(t1)
+	if err != nil {
+		return err
+	}
+
+	var old string
+	if data, err := view.Value("v"); err != nil {
+		return err
+	} else if err := msgpack.Unmarshal(data, &old); err != nil || old != "first" {
+		return fmt.Errorf("value at %d is %q", t1, old)
+	}
+
+	changes, err := a.Diff(t1, t2)
+	if err != nil {
+		return err
+	} else if len(changes) != 1 || changes[0].Kind != crdt.Valued || changes[0].Name != "v" {
+		return fmt.Errorf("diff %v", changes)
+	}
+
+	return nil
+}
+
+// los cambios de valor de una replica que no es duena se ignoran en todas
+// las replicas, tambien los que se hicieron antes de conocer los duenos
+func testValueOwners(trees []*crdt.Tree, _ *bus) error {
+	a, b := trees[0], trees[1]
+	a.AddWithValue("n", "root", []byte{1})
+	fork := b.Fork()
+	if err := fork.SetValue("n", []byte{2}); err != nil {
+		return err
+	} else if err := fork.AddWithValue("m", "n", []byte{3}); err != nil {
+		return err
+	}
+
+	if err := a.SetOwners("n", []uint64{0}); err != nil {
+		return err
+	} else if err := b.SetValue("n", []byte{4}); err == nil {
+		return fmt.Errorf("value set without permission")
+	}
+
+	conflicts, err := b.MergeFork(fork)
+	if err != nil {
+		return err
+	} else if len(conflicts) != 2 {
+		return fmt.Errorf("%d conflicts merging the fork", len(conflicts))
+	}
+
+	for _, tree := range []*crdt.Tree{a, b} {
+		n, _ := tree.Value("n")
+		m, _ := tree.Value("m")
+		if !reflect.DeepEqual(n, []byte{1}) || m != nil {
+			return fmt.Errorf("replica %d has values %v and %v", tree.GetID(), n, m)
+		}
+	}
+
+	return nil
+}
+
+// un arbol con firmas no carga el estado de otra replica, incluiria
+// operaciones sin firmar
+func testSignedSnapshot(trees []*crdt.Tree, _ *bus) error {
+	a, b := trees[0], trees[1]
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		return err
+	}
+
+	registry := crdt.NewKeyRegistry()
+	registry.Add(0, key.Public().(ed25519.PublicKey))
+	a.EnableSigning(key, registry)
+	if err := b.Add("unsigned", "root"); err != nil {
+		return err
+	}
+
+	// b responde al pedido con su estado para las demas replicas
+	b.ApplyRemoteOperation(network.SyncRequestMessage(""))
+	time.Sleep(100 * time.Millisecond)
+	for _, name := range a.GetNames() {
+		if name == "unsigned" {
+			return fmt.Errorf("signed tree loaded the snapshot")
+		}
+	}
+
+	return nil
+}
+
+// una operacion atrasada revierte un cambio de nombre y el nombre que se
+// libero sigue siendo del nodo que lo tomo despues
+func testLateRename(trees []*crdt.Tree, conns *bus) error {
+	conns.hold(0)
+	trees[0].Add("late", "root")
+	if err := trees[1].Add("a", "root"); err != nil {
+		return err
+	} else if err := trees[1].Rename("a", "b"); err != nil {
+		return err
+	} else if err := trees[2].Add("a", "root"); err != nil {
+		return err
+	}
+
+	conns.release(0)
+	for i, tree := range trees {
+		if err := tree.Add(fmt.Sprint("d", i), "a"); err != nil {
+			return fmt.Errorf("replica %d: %v", i, err)
+		}
+	}
+
+	return nil
+}
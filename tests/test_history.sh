@@ -0,0 +1,14 @@
+#!/bin/sh
+echo "HISTORY TEST"
+echo "Compiling test..."
+if ! go build ./test_history.go; then
+	echo "Compilation error"
+	exit 1
+fi
+
+if ! ./test_history.exe 2> /dev/null; then
+	echo "ERROR: History test failed"
+	exit 1
+fi
+
+echo "OK: Test passed"
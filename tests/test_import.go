@@ -0,0 +1,197 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"udr-tree/crdt"
+	"udr-tree/network"
+)
+
+// Conexion que entrega cada paquete al otro arbol del par
+type pairConn struct {
+	pair *pair
+	id   int
+}
+
+type pair struct {
+	sync.Mutex
+	trees [2]*crdt.Tree
+}
+
+func (conn *pairConn) Send(data []byte) {
+	conn.pair.Lock()
+	other := conn.pair.trees[1-conn.id]
+	conn.pair.Unlock()
+	if other != nil {
+		other.ApplyRemoteOperation(data)
+	}
+}
+
+func (conn *pairConn) Connect()    {}
+func (conn *pairConn) Disconnect() {}
+func (conn *pairConn) Close()      {}
+
+// Prueba la exportacion y la importacion con pares de replicas en el
+// mismo proceso
+func main() {
+	tests := []struct {
+		name string
+		run  func() error
+	}{
+		{"json round trip", testJSON},
+		{"csv round trip", testCSV},
+		{"csv cycle", testCycle},
+		{"duplicated names", testDuplicates},
+		{"directory", testDir},
+	}
+
+	failed := false
+	for _, test := range tests {
+		if err := test.run(); err != nil {
+			fmt.Println("FAIL:", test.name+":", err)
+			failed = true
+		} else {
+			fmt.Println("OK:", test.name)
+		}
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
+
+func start() [2]*crdt.Tree {
+	p := &pair{}
+	var trees [2]*crdt.Tree
+	for i := range trees {
+		trees[i] = crdt.NewTreeWithConn(i, func(network.CRDTTree) network.ReplicaConn {
+			return &pairConn{p, i}
+		})
+	}
+
+	p.Lock()
+	p.trees = trees
+	p.Unlock()
+	return trees
+}
+
+func export(tree *crdt.Tree, format crdt.Format, opts crdt.ExportOptions) string {
+	var buf bytes.Buffer
+	if err := tree.Export(&buf, format, opts); err != nil {
+		panic(err)
+	}
+
+	return buf.String()
+}
+
+// arbol de ejemplo con varios niveles
+func sample(tree *crdt.Tree) {
+	tree.Add("a", "root")
+	tree.Add("b", "a")
+	tree.Add("c", "b")
+	tree.Add("d", "root")
+	tree.Add("e", "d")
+}
+
+// la importacion llega a la otra replica del par en un solo paquete
+func roundTrip(format crdt.Format) error {
+	from := start()
+	sample(from[0])
+	data := export(from[0], format, crdt.ExportOptions{})
+
+	to := start()
+	n, err := to[0].Import(strings.NewReader(data), format, "root")
+	if err != nil {
+		return err
+	} else if n != 5 {
+		return fmt.Errorf("imported %d nodes", n)
+	}
+
+	opts := crdt.ExportOptions{IDs: true, Trash: true}
+	if got := export(to[0], crdt.FormatJSON, crdt.ExportOptions{}); got != export(from[0], crdt.FormatJSON, crdt.ExportOptions{}) {
+		return fmt.Errorf("imported tree differs:\n%s", got)
+	} else if export(to[0], crdt.FormatJSON, opts) != export(to[1], crdt.FormatJSON, opts) {
+		return fmt.Errorf("the other replica differs")
+	}
+
+	return nil
+}
+
+func testJSON() error {
+	return roundTrip(crdt.FormatJSON)
+}
+
+func testCSV() error {
+	return roundTrip(crdt.FormatCSV)
+}
+
+func testCycle() error {
+	trees := start()
+	csv := "id,parent,name\n1,2,a\n2,1,b\n3,,c\n"
+	if _, err := trees[0].Import(strings.NewReader(csv), crdt.FormatCSV, "root"); err == nil || !strings.Contains(err.Error(), "cycle: 1, 2") {
+		return fmt.Errorf("error %v", err)
+	} else if names := trees[0].GetNames(); len(names) != 1 {
+		return fmt.Errorf("nodes created: %v", names)
+	}
+
+	return nil
+}
+
+// no se crea ningun nodo si un nombre ya existe o se repite
+func testDuplicates() error {
+	trees := start()
+	trees[0].Add("x", "root")
+	for _, data := range []string{
+		`{"name": "root", "children": [{"name": "y"}, {"name": "x"}]}`,
+		`[{"name": "y", "children": [{"name": "z"}]}, {"name": "z"}]`,
+	} {
+		if _, err := trees[0].Import(strings.NewReader(data), crdt.FormatJSON, "root"); err == nil {
+			return fmt.Errorf("imported %s", data)
+		} else if names := trees[0].GetNames(); len(names) != 2 {
+			return fmt.Errorf("nodes created: %v", names)
+		}
+	}
+
+	return nil
+}
+
+func testDir() error {
+	dir, err := os.MkdirTemp("", "import")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	for _, p := range []string{"a/b/c", "d/e"} {
+		if err := os.MkdirAll(filepath.Join(dir, filepath.FromSlash(p)), 0755); err != nil {
+			return err
+		}
+	}
+
+	// los archivos no son nodos
+	if err := os.WriteFile(filepath.Join(dir, "a", "file"), nil, 0644); err != nil {
+		return err
+	}
+
+	trees, want := start(), start()
+	sample(want[0])
+	if n, err := trees[0].ImportDir(dir, "root"); err != nil {
+		return err
+	} else if n != 5 {
+		return fmt.Errorf("imported %d nodes", n)
+	} else if got := export(trees[1], crdt.FormatJSON, crdt.ExportOptions{}); got != export(want[0], crdt.FormatJSON, crdt.ExportOptions{}) {
+		return fmt.Errorf("imported tree differs:\n%s", got)
+	}
+
+	return nil
+}
@@ -0,0 +1,14 @@
+#!/bin/sh
+echo "IMPORT TEST"
+echo "Compiling test..."
+if ! go build ./test_import.go; then
+	echo "Compilation error"
+	exit 1
+fi
+
+if ! ./test_import.exe 2> /dev/null; then
+	echo "ERROR: Import test failed"
+	exit 1
+fi
+
+echo "OK: Test passed"
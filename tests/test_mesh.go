@@ -0,0 +1,136 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"time"
+	"udr-tree/crdt"
+	"udr-tree/network"
+)
+
+// Prueba la conexion sin servidor con replicas en el mismo proceso
+func main() {
+	addrs := freeAddrs(3)
+	trees := make([]*crdt.Tree, len(addrs))
+	var wg sync.WaitGroup
+	for id := range addrs {
+		// la ultima replica empieza despues, las demas reintentan
+		if id == len(addrs)-1 {
+			wg.Wait()
+		}
+
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			trees[id] = crdt.NewTreeWithConn(id, func(tree network.CRDTTree) network.ReplicaConn {
+				var peers []string
+				for i, addr := range addrs {
+					if i != id {
+						peers = append(peers, addr)
+					}
+				}
+				return network.NewMeshConn(tree, addrs[id], peers)
+			})
+		}(id)
+	}
+	wg.Wait()
+
+	nodes := []string{"root"}
+	random := func(n int) {
+		for i := 0; i < n; i++ {
+			tree := trees[rand.Intn(len(trees))]
+			if i%3 == 0 || len(nodes) == 1 {
+				name := fmt.Sprint("node", len(nodes))
+				if tree.Add(name, nodes[rand.Intn(len(nodes))]) == nil {
+					nodes = append(nodes, name)
+				}
+				time.Sleep(10 * time.Millisecond)
+			} else {
+				tree.Move(nodes[1+rand.Intn(len(nodes)-1)], nodes[rand.Intn(len(nodes))])
+			}
+		}
+	}
+
+	random(100)
+	time.Sleep(time.Second)
+	if err := compare(trees, len(nodes)); err != nil {
+		fail("broadcast", err)
+	}
+	fmt.Println("OK: broadcast")
+
+	// la replica 1 sigue operando sin conexion y al volver se reenvia lo
+	// que los demas no recibieron
+	trees[1].Disconnect()
+	for i := 0; i < 20; i++ {
+		trees[1].Move(nodes[1+rand.Intn(len(nodes)-1)], nodes[rand.Intn(len(nodes))])
+	}
+	trees[1].Add("offline", "root")
+	trees[0].Add("online", "root")
+	time.Sleep(500 * time.Millisecond)
+	trees[1].Connect()
+	time.Sleep(3 * network.MeshRetryInterval)
+	if err := compare(trees, len(nodes)+2); err != nil {
+		fail("reconnection", err)
+	}
+	fmt.Println("OK: reconnection")
+
+	for _, tree := range trees {
+		tree.Close()
+	}
+}
+
+func fail(name string, err error) {
+	fmt.Println("FAIL:", name+":", err)
+	os.Exit(1)
+}
+
+func freeAddrs(n int) []string {
+	var addrs []string
+	for i := 0; i < n; i++ {
+		ln, err := net.Listen("tcp", "localhost:0")
+		if err != nil {
+			panic(err)
+		}
+
+		addrs = append(addrs, ln.Addr().String())
+		ln.Close()
+	}
+
+	return addrs
+}
+
+// compara la estructura completa con los IDs y la papelera, no solo los
+// nombres, asi un padre distinto tambien es una diferencia
+func compare(trees []*crdt.Tree, n int) error {
+	exports := make([]string, len(trees))
+	for i, tree := range trees {
+		var buf bytes.Buffer
+		if err := tree.Export(&buf, crdt.FormatJSON, crdt.ExportOptions{Trash: true, IDs: true}); err != nil {
+			return err
+		}
+
+		exports[i] = buf.String()
+	}
+
+	for i := range trees {
+		if exports[0] != exports[i] {
+			return fmt.Errorf("trees 0 and %d differ:\n%s\n%s", i, exports[0], exports[i])
+		}
+	}
+
+	if names := trees[0].GetNames(); len(names) != n {
+		return fmt.Errorf("trees have %d nodes", len(names))
+	}
+
+	return nil
+}
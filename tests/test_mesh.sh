@@ -0,0 +1,14 @@
+#!/bin/sh
+echo "MESH TEST"
+echo "Compiling test..."
+if ! go build ./test_mesh.go; then
+	echo "Compilation error"
+	exit 1
+fi
+
+if ! ./test_mesh.exe 2> /dev/null; then
+	echo "ERROR: Mesh test failed"
+	exit 1
+fi
+
+echo "OK: Test passed"
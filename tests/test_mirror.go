@@ -0,0 +1,181 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+	"udr-tree/crdt"
+	"udr-tree/mirror"
+	"udr-tree/network"
+)
+
+// Prueba el reflejo de un directorio con una replica sin peers
+func main() {
+	tree := crdt.NewTreeWithConn(0, func(tree network.CRDTTree) network.ReplicaConn {
+		return network.NewMeshConn(tree, "localhost:0", nil)
+	})
+	defer tree.Close()
+
+	tests := []struct {
+		name string
+		run  func(tree *crdt.Tree, m *mirror.Mirror, dir string) error
+	}{
+		{"local folders", testLocal},
+		{"remote folders", testRemote},
+		{"local rename", testLocalRename},
+		{"remote rename", testRemoteRename},
+		{"name outside the mirror", testOutside},
+		{"restore from trash", testRestore},
+	}
+
+	dir, err := os.MkdirTemp("", "mirror")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tree.Add("docs", "root")
+	m := mirror.New(tree, dir, "docs", time.Second)
+	defer m.Stop()
+	failed := false
+	for _, test := range tests {
+		if err := test.run(tree, m, dir); err != nil {
+			fmt.Println("FAIL:", test.name+":", err)
+			failed = true
+		} else {
+			fmt.Println("OK:", test.name)
+		}
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// el ID del nodo en el camino p dentro de docs, o un error
+func nodeAt(tree *crdt.Tree, p string) (string, error) {
+	paths, err := tree.Paths("docs")
+	if err != nil {
+		return "", err
+	} else if id, ok := paths[p]; ok {
+		return id.String(), nil
+	}
+
+	return "", fmt.Errorf("%s is not in the tree", p)
+}
+
+func exists(dir, p string) bool {
+	_, err := os.Stat(filepath.Join(dir, filepath.FromSlash(p)))
+	return err == nil
+}
+
+func testLocal(tree *crdt.Tree, m *mirror.Mirror, dir string) error {
+	if err := os.MkdirAll(filepath.Join(dir, "a", "b"), 0755); err != nil {
+		return err
+	} else if err := m.Poll(); err != nil {
+		return err
+	}
+
+	_, err := nodeAt(tree, "a/b")
+	return err
+}
+
+func testRemote(tree *crdt.Tree, m *mirror.Mirror, dir string) error {
+	if err := tree.Add("c", "a"); err != nil {
+		return err
+	} else if err := m.Poll(); err != nil {
+		return err
+	} else if !exists(dir, "a/c") {
+		return fmt.Errorf("folder not created")
+	}
+
+	return nil
+}
+
+func testLocalRename(tree *crdt.Tree, m *mirror.Mirror, dir string) error {
+	before, err := nodeAt(tree, "a/b")
+	if err != nil {
+		return err
+	} else if err := os.Rename(filepath.Join(dir, "a", "b"), filepath.Join(dir, "b2")); err != nil {
+		return err
+	} else if err := m.Poll(); err != nil {
+		return err
+	}
+
+	after, err := nodeAt(tree, "b2")
+	if err != nil {
+		return err
+	} else if before != after {
+		return fmt.Errorf("renamed folder is a new node")
+	}
+
+	return nil
+}
+
+func testRemoteRename(tree *crdt.Tree, m *mirror.Mirror, dir string) error {
+	if err := os.WriteFile(filepath.Join(dir, "a", "c", "file"), []byte("data"), 0644); err != nil {
+		return err
+	} else if err := tree.Rename("c", "c2"); err != nil {
+		return err
+	} else if err := m.Poll(); err != nil {
+		return err
+	} else if !exists(dir, "a/c2/file") || exists(dir, "a/c") {
+		return fmt.Errorf("folder not renamed")
+	} else if _, err := nodeAt(tree, "a/c"); err == nil {
+		return fmt.Errorf("old name restored in the tree")
+	}
+
+	return nil
+}
+
+func testOutside(tree *crdt.Tree, m *mirror.Mirror, dir string) error {
+	if err := tree.Add("outside", "root"); err != nil {
+		return err
+	} else if err := os.Mkdir(filepath.Join(dir, "outside"), 0755); err != nil {
+		return err
+	} else if err := m.Poll(); err != nil {
+		return err
+	} else if _, err := nodeAt(tree, "outside"); err == nil {
+		return fmt.Errorf("node outside the mirror moved into it")
+	}
+
+	// la carpeta local se conserva aunque no este en el arbol
+	if err := os.Mkdir(filepath.Join(dir, "outside", "child"), 0755); err != nil {
+		return err
+	} else if err := m.Poll(); err != nil {
+		return err
+	} else if !exists(dir, "outside/child") {
+		return fmt.Errorf("local folder removed")
+	} else if _, err := nodeAt(tree, "child"); err == nil {
+		return fmt.Errorf("child of a folder outside the tree added")
+	}
+
+	// borrarla no borra el nodo con el mismo nombre
+	os.RemoveAll(filepath.Join(dir, "outside"))
+	if err := m.Poll(); err != nil {
+		return err
+	} else if tree.InTrash("outside") {
+		return fmt.Errorf("node outside the mirror removed")
+	}
+
+	return nil
+}
+
+func testRestore(tree *crdt.Tree, m *mirror.Mirror, dir string) error {
+	if err := tree.Remove("c2"); err != nil {
+		return err
+	} else if err := m.Poll(); err != nil {
+		return err
+	} else if _, err := nodeAt(tree, "a/c2"); err != nil {
+		return fmt.Errorf("folder with files not restored: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,14 @@
+#!/bin/sh
+echo "MIRROR TEST"
+echo "Compiling test..."
+if ! go build ./test_mirror.go; then
+	echo "Compilation error"
+	exit 1
+fi
+
+if ! ./test_mirror.exe 2> /dev/null; then
+	echo "ERROR: Mirror test failed"
+	exit 1
+fi
+
+echo "OK: Test passed"
@@ -0,0 +1,838 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"udr-tree/crdt"
+	"udr-tree/network"
+	"udr-tree/server"
+
+	"github.com/gorilla/websocket"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Prueba el servidor con clientes en el mismo proceso
+func main() {
+	tests := []struct {
+		name string
+		run  func(srv *server.Server, addr string) error
+	}{
+		{"handshake", testHandshake},
+		{"broadcast", testBroadcast},
+		{"documents", testDocuments},
+		{"slow replica", testSlowReplica},
+		{"offline replica", testOfflineReplica},
+		{"backlog on disk", testBacklogDir},
+		{"trees", testTrees},
+		{"late replica", testLateReplica},
+		{"websocket", testWebSocket},
+		{"websocket origin and close", testWebSocketClose},
+		{"server restart", testRestart},
+		{"protocol", testProtocol},
+		{"heartbeats while disconnected", testDisconnectedHeartbeats},
+		{"resync", testResync},
+		{"codec negotiation", testCodecs},
+		{"batching", testBatching},
+		{"version 1", testVersion1},
+	}
+
+	failed := false
+	for _, test := range tests {
+		srv, addr := start("")
+		err := test.run(srv, addr)
+		srv.Close()
+		if err != nil {
+			fmt.Println("FAIL:", test.name+":", err)
+			failed = true
+		} else {
+			fmt.Println("OK:", test.name)
+		}
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
+
+func start(dir string) (*server.Server, string) {
+	config := server.DefaultConfig
+	config.MaxReplicas = 3
+	config.BacklogSize = 1000
+	config.BacklogDir = dir
+	config.SnapshotEvery = 20
+	srv, err := server.New(config)
+	if err != nil {
+		panic(err)
+	}
+
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		panic(err)
+	}
+
+	go srv.Serve(ln)
+	return srv, ln.Addr().String()
+}
+
+type testClient struct {
+	id       uint64
+	received uint64
+	conn     net.Conn
+	dec      *msgpack.Decoder
+	v1       bool
+}
+
+func dial(addr string, hello network.Hello) (*testClient, error) {
+	conn, err := network.Dial(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &testClient{conn: conn, dec: msgpack.NewDecoder(conn)}
+	reply, err := network.Handshake(conn, c.dec, hello)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	c.id = reply.ReplicaID
+	c.received = reply.Received
+	c.v1 = hello.Version == 1
+	return c, nil
+}
+
+// mensajes con el documento doc y size bytes de relleno, sin sobre para
+// las replicas de la version 1
+func (c *testClient) send(doc string, n, size int) {
+	data, err := msgpack.Marshal(map[string]any{"Document": doc, "Data": make([]byte, size)})
+	if err != nil {
+		panic(err)
+	}
+
+	if !c.v1 {
+		data = network.OperationMessage(doc, data)
+	}
+
+	for i := 0; i < n; i++ {
+		c.conn.Write(data)
+	}
+}
+
+// cantidad de mensajes recibidos hasta que pasa timeout sin mensajes,
+// se confirman cada 10 mensajes y al final
+func (c *testClient) receive(timeout time.Duration) int {
+	n := 0
+	for {
+		c.conn.SetReadDeadline(time.Now().Add(timeout))
+		if _, err := c.dec.DecodeRaw(); err != nil {
+			c.conn.Write(network.AckMessage(c.received))
+			return n
+		}
+
+		n++
+		c.received++
+		if c.received%10 == 0 {
+			c.conn.Write(network.AckMessage(c.received))
+		}
+	}
+}
+
+func testHandshake(srv *server.Server, addr string) error {
+	a, err := dial(addr, network.Hello{Assign: true})
+	if err != nil {
+		return err
+	}
+	defer a.conn.Close()
+
+	b, err := dial(addr, network.Hello{ReplicaID: 2})
+	if err != nil {
+		return err
+	}
+	defer b.conn.Close()
+
+	c, err := dial(addr, network.Hello{Assign: true})
+	if err != nil {
+		return err
+	}
+	defer c.conn.Close()
+
+	if a.id != 0 || b.id != 2 || c.id != 1 {
+		return fmt.Errorf("assigned ids %d %d %d", a.id, b.id, c.id)
+	} else if _, err := dial(addr, network.Hello{ReplicaID: 2}); err == nil {
+		return fmt.Errorf("duplicated replica id accepted")
+	} else if _, err := dial(addr, network.Hello{Assign: true}); err == nil {
+		return fmt.Errorf("replica accepted with all ids in use")
+	}
+
+	b.conn.Close()
+	time.Sleep(100 * time.Millisecond)
+	d, err := dial(addr, network.Hello{ReplicaID: 2})
+	if err != nil {
+		return fmt.Errorf("id not released after disconnect: %v", err)
+	}
+
+	d.conn.Close()
+	if _, err := dial(addr, network.Hello{ReplicaID: 7}); err == nil {
+		return fmt.Errorf("out of range replica id accepted")
+	}
+
+	return nil
+}
+
+func testBroadcast(srv *server.Server, addr string) error {
+	a, _ := dial(addr, network.Hello{Assign: true})
+	b, _ := dial(addr, network.Hello{Assign: true})
+	c, _ := dial(addr, network.Hello{Assign: true})
+	defer a.conn.Close()
+	defer b.conn.Close()
+	defer c.conn.Close()
+
+	a.send("", 10, 0)
+	got := []int{a.receive(200 * time.Millisecond), b.receive(200 * time.Millisecond), c.receive(200 * time.Millisecond)}
+	if !reflect.DeepEqual(got, []int{0, 10, 10}) {
+		return fmt.Errorf("received %v messages", got)
+	}
+
+	return nil
+}
+
+func testDocuments(srv *server.Server, addr string) error {
+	a, _ := dial(addr, network.Hello{Assign: true})
+	b, _ := dial(addr, network.Hello{Assign: true})
+	c, _ := dial(addr, network.Hello{Assign: true})
+	defer a.conn.Close()
+	defer b.conn.Close()
+	defer c.conn.Close()
+
+	b.conn.Write(network.SubscribeMessage("doc"))
+	time.Sleep(100 * time.Millisecond)
+	a.send("doc", 5, 0)
+	a.send("other", 5, 0)
+	got := []int{b.receive(200 * time.Millisecond), c.receive(200 * time.Millisecond)}
+	if !reflect.DeepEqual(got, []int{5, 0}) {
+		return fmt.Errorf("received %v messages", got)
+	}
+
+	return nil
+}
+
+// c no lee, a y b se siguen comunicando y c termina desconectada
+func testSlowReplica(srv *server.Server, addr string) error {
+	a, _ := dial(addr, network.Hello{Assign: true})
+	b, _ := dial(addr, network.Hello{Assign: true})
+	c, _ := dial(addr, network.Hello{Assign: true})
+	defer a.conn.Close()
+	defer b.conn.Close()
+	defer c.conn.Close()
+
+	done := make(chan int)
+	go func() {
+		done <- b.receive(time.Second)
+	}()
+
+	// se envia de a poco para que b alcance a leer
+	for i := 0; i < 400; i++ {
+		a.send("", 50, 1024)
+		time.Sleep(time.Millisecond)
+	}
+
+	if n := <-done; n != 20000 {
+		return fmt.Errorf("fast replica received %d messages", n)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	c.conn.SetReadDeadline(time.Now().Add(time.Second))
+	for {
+		if _, err := c.dec.DecodeRaw(); err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				return fmt.Errorf("slow replica was not disconnected")
+			}
+
+			return nil
+		}
+	}
+}
+
+// b se desconecta y al volver recibe lo que se perdio
+func testOfflineReplica(srv *server.Server, addr string) error {
+	a, _ := dial(addr, network.Hello{Assign: true})
+	b, _ := dial(addr, network.Hello{Assign: true})
+	defer a.conn.Close()
+
+	a.send("", 5, 0)
+	if n := b.receive(200 * time.Millisecond); n != 5 {
+		return fmt.Errorf("received %d messages", n)
+	}
+
+	b.conn.Close()
+	time.Sleep(100 * time.Millisecond)
+	a.send("", 10, 0)
+	time.Sleep(100 * time.Millisecond)
+	b, err := dial(addr, network.Hello{ReplicaID: b.id, Received: b.received})
+	if err != nil {
+		return err
+	}
+	defer b.conn.Close()
+
+	if n := b.receive(200 * time.Millisecond); n != 10 || b.received != 15 {
+		return fmt.Errorf("received %d messages after reconnecting", n)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if n := srv.Backlog(b.id); n != 0 {
+		return fmt.Errorf("%d messages still in backlog", n)
+	}
+
+	return nil
+}
+
+// los mensajes pendientes sobreviven a un reinicio del servidor
+func testBacklogDir(*server.Server, string) error {
+	dir, err := os.MkdirTemp("", "backlog")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	srv, addr := start(dir)
+	a, _ := dial(addr, network.Hello{ReplicaID: 0})
+	b, _ := dial(addr, network.Hello{ReplicaID: 1})
+	b.conn.Write(network.SubscribeMessage("doc"))
+	time.Sleep(100 * time.Millisecond)
+	b.conn.Close()
+	time.Sleep(100 * time.Millisecond)
+	a.send("", 7, 100)
+	time.Sleep(100 * time.Millisecond)
+	a.conn.Close()
+	srv.Close()
+
+	srv, addr = start(dir)
+	defer srv.Close()
+	if n := srv.Backlog(1); n != 7 {
+		return fmt.Errorf("%d messages loaded from disk", n)
+	}
+
+	// las suscripciones tambien se cargan del disco
+	a, _ = dial(addr, network.Hello{ReplicaID: 0})
+	a.send("doc", 3, 0)
+	time.Sleep(100 * time.Millisecond)
+	a.conn.Close()
+	b, err = dial(addr, network.Hello{ReplicaID: 1})
+	if err != nil {
+		return err
+	}
+	defer b.conn.Close()
+
+	if n := b.receive(200 * time.Millisecond); n != 10 {
+		return fmt.Errorf("received %d messages after restart", n)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if n := srv.Backlog(1); n != 0 {
+		return fmt.Errorf("%d messages still in backlog", n)
+	}
+
+	return nil
+}
+
+func testTrees(srv *server.Server, addr string) error {
+	var trees []*crdt.Tree
+	for id := 0; id < 3; id++ {
+		trees = append(trees, crdt.NewTree(id, addr))
+	}
+
+	for i, tree := range trees {
+		tree.Add(fmt.Sprint("node", i), "root")
+	}
+
+	trees[0].Move("node1", "node0")
+	trees[2].Move("node0", "node1")
+	time.Sleep(time.Second)
+	names := make([][]string, len(trees))
+	for i, tree := range trees {
+		names[i] = tree.GetNames()
+		sort.Strings(names[i])
+		tree.Close()
+	}
+
+	for i := range trees {
+		if !reflect.DeepEqual(names[0], names[i]) {
+			return fmt.Errorf("trees 0 and %d differ: %v %v", i, names[0], names[i])
+		}
+	}
+
+	if len(names[0]) != 4 {
+		return fmt.Errorf("trees have %d nodes", len(names[0]))
+	}
+
+	return nil
+}
+
+// la replica 2 se conecta despues de muchas operaciones y recibe el
+// estado de otra replica y las operaciones posteriores
+func testLateReplica(srv *server.Server, addr string) error {
+	trees := []*crdt.Tree{crdt.NewTree(0, addr), crdt.NewTree(1, addr)}
+	nodes := []string{"root"}
+	for i := 0; i < 100; i++ {
+		tree := trees[i%2]
+		if i%3 == 0 {
+			name := fmt.Sprint("node", i)
+			tree.Add(name, nodes[rand.Intn(len(nodes))])
+			nodes = append(nodes, name)
+			time.Sleep(10 * time.Millisecond)
+		} else {
+			tree.Move(nodes[1+rand.Intn(len(nodes)-1)], nodes[rand.Intn(len(nodes))])
+		}
+	}
+
+	time.Sleep(time.Second)
+	if snapshot, _ := srv.DocumentLog(""); !snapshot {
+		return fmt.Errorf("the server did not receive a snapshot")
+	}
+
+	trees = append(trees, crdt.NewTree(2, addr))
+	trees[2].Add("late", "root")
+	time.Sleep(time.Second)
+	names := make([][]string, len(trees))
+	for i, tree := range trees {
+		names[i] = tree.GetNames()
+		sort.Strings(names[i])
+		tree.Close()
+	}
+
+	for i := range trees {
+		if !reflect.DeepEqual(names[0], names[i]) {
+			return fmt.Errorf("trees 0 and %d differ: %v %v", i, names[0], names[i])
+		}
+	}
+
+	if len(names[0]) != len(nodes)+1 {
+		return fmt.Errorf("trees have %d nodes", len(names[0]))
+	}
+
+	return nil
+}
+
+// replicas por WebSocket y por TCP en el mismo servidor
+func testWebSocket(srv *server.Server, addr string) error {
+	web := httptest.NewServer(srv)
+	defer web.Close()
+	url := "ws" + strings.TrimPrefix(web.URL, "http") + network.WebSocketPath
+
+	a, err := dial(url, network.Hello{Assign: true})
+	if err != nil {
+		return err
+	}
+	b, _ := dial(addr, network.Hello{Assign: true})
+	a.send("", 10, 100)
+	b.send("", 5, 0)
+	got := []int{a.receive(200 * time.Millisecond), b.receive(200 * time.Millisecond)}
+	a.conn.Close()
+	b.conn.Close()
+	if !reflect.DeepEqual(got, []int{5, 10}) {
+		return fmt.Errorf("received %v messages", got)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	trees := []*crdt.Tree{crdt.NewTree(0, url), crdt.NewTree(1, addr)}
+	trees[0].Add("web", "root")
+	time.Sleep(100 * time.Millisecond)
+	trees[1].Add("tcp", "web")
+	time.Sleep(time.Second)
+	names := make([][]string, len(trees))
+	for i, tree := range trees {
+		names[i] = tree.GetNames()
+		sort.Strings(names[i])
+		tree.Close()
+	}
+
+	if !reflect.DeepEqual(names[0], names[1]) || len(names[0]) != 3 {
+		return fmt.Errorf("trees differ: %v %v", names[0], names[1])
+	}
+
+	return nil
+}
+
+// las paginas de otros sitios no se conectan y Close cierra el endpoint
+func testWebSocketClose(srv *server.Server, addr string) error {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		return err
+	}
+	web := ln.Addr().String()
+	ln.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- srv.ListenAndServeWebSocket(web)
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	url := "ws://" + web + network.WebSocketPath
+	for origin, ok := range map[string]bool{"": true, "http://" + web: true, "http://other.example": false} {
+		header := http.Header{}
+		if origin != "" {
+			header.Set("Origin", origin)
+		}
+
+		ws, _, err := websocket.DefaultDialer.Dial(url, header)
+		if (err == nil) != ok {
+			return fmt.Errorf("origin %q accepted: %v", origin, err == nil)
+		} else if err == nil {
+			ws.Close()
+		}
+	}
+
+	srv.Close()
+	select {
+	case err := <-done:
+		if err != nil {
+			return err
+		}
+	case <-time.After(time.Second):
+		return fmt.Errorf("websocket endpoint not closed")
+	}
+
+	if conn, err := net.Dial("tcp", web); err == nil {
+		conn.Close()
+		return fmt.Errorf("websocket endpoint still accepts connections")
+	}
+
+	return nil
+}
+
+// el servidor se reinicia, las replicas reconectan solas y envian las
+// operaciones que hicieron mientras tanto
+func testRestart(srv *server.Server, addr string) error {
+	trees := []*crdt.Tree{crdt.NewTree(0, addr), crdt.NewTree(1, addr)}
+	defer func() {
+		for _, tree := range trees {
+			tree.Close()
+		}
+	}()
+
+	trees[0].Add("before", "root")
+	time.Sleep(100 * time.Millisecond)
+	srv.Close()
+	time.Sleep(100 * time.Millisecond)
+	if state := trees[1].ConnState(); state != network.StateReconnecting {
+		return fmt.Errorf("replica is %v after the server stopped", state)
+	}
+
+	trees[0].Add("offline0", "before")
+	trees[1].Add("offline1", "before")
+	time.Sleep(500 * time.Millisecond)
+
+	config := server.DefaultConfig
+	config.MaxReplicas = 3
+	srv, err := server.New(config)
+	if err != nil {
+		return err
+	}
+	defer srv.Close()
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	go srv.Serve(ln)
+	time.Sleep(3 * time.Second)
+	for _, tree := range trees {
+		if state := tree.ConnState(); state != network.StateConnected {
+			return fmt.Errorf("replica is %v after the server restarted", state)
+		}
+	}
+
+	names := [][]string{trees[0].GetNames(), trees[1].GetNames()}
+	sort.Strings(names[0])
+	sort.Strings(names[1])
+	if !reflect.DeepEqual(names[0], names[1]) || len(names[0]) != 4 {
+		return fmt.Errorf("trees differ: %v %v", names[0], names[1])
+	}
+
+	return nil
+}
+
+// version, documentos y heartbeats del handshake
+func testProtocol(srv *server.Server, addr string) error {
+	if _, err := dial(addr, network.Hello{Assign: true, Version: network.ProtocolVersion + 1}); err == nil {
+		return fmt.Errorf("unsupported protocol version accepted")
+	}
+
+	a, _ := dial(addr, network.Hello{Assign: true})
+	defer a.conn.Close()
+
+	conn, err := network.Dial(addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	b := &testClient{conn: conn, dec: msgpack.NewDecoder(conn)}
+	reply, err := network.Handshake(conn, b.dec, network.Hello{
+		Assign:    true,
+		Documents: []string{"doc"},
+		Features:  []string{network.FeatureHeartbeat},
+	})
+	if err != nil {
+		return err
+	} else if reply.Version != network.ProtocolVersion || !reply.Supports(network.FeatureHeartbeat) {
+		return fmt.Errorf("reply with version %d and features %v", reply.Version, reply.Features)
+	}
+
+	a.send("doc", 5, 0)
+	if n := b.receive(200 * time.Millisecond); n != 5 {
+		return fmt.Errorf("received %d messages of a document opened in the handshake", n)
+	}
+
+	conn.Write(network.HeartbeatMessage())
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	data, err := b.dec.DecodeRaw()
+	if err != nil {
+		return fmt.Errorf("no heartbeat reply: %v", err)
+	} else if env, err := network.ReadEnvelope(data); err != nil || env.Type != network.TypeHeartbeat {
+		return fmt.Errorf("unexpected reply to a heartbeat")
+	}
+
+	// los mensajes de la version 1 se distinguen por sus campos
+	for message, want := range map[string]network.MessageType{
+		string(network.SyncRequestMessage("doc")):                                          network.TypeSyncRequest,
+		string(network.SnapshotMessage(network.Snapshot{Document: "doc", Data: []byte{1}})): network.TypeSnapshot,
+		string(network.SubscribeMessage("doc")):                                            network.TypeSubscribe,
+	} {
+		env, err := network.ReadEnvelope([]byte(message))
+		if err != nil || env.Type != want || env.Document != "doc" {
+			return fmt.Errorf("message with type %d: %v", env.Type, err)
+		}
+
+		wrapped, err := network.Wrap(env.Payload)
+		if err != nil || !bytes.Equal(wrapped, []byte(message)) {
+			return fmt.Errorf("version 1 message with type %d wrapped as %v: %v", want, wrapped, err)
+		}
+	}
+
+	// con FeatureAccepted el servidor responde cada Ack con los mensajes
+	// que recibio de la replica
+	c, err := dial(addr, network.Hello{Assign: true, Features: []string{network.FeatureAccepted}})
+	if err != nil {
+		return err
+	}
+	defer c.conn.Close()
+
+	c.send("doc", 3, 0)
+	c.conn.Write(network.AckMessage(0))
+	c.conn.SetReadDeadline(time.Now().Add(time.Second))
+	var ack network.Ack
+	if data, err := c.dec.DecodeRaw(); err != nil {
+		return fmt.Errorf("no reply to an ack: %v", err)
+	} else if env, err := network.ReadEnvelope(data); err != nil || env.Type != network.TypeAck {
+		return fmt.Errorf("unexpected reply to an ack")
+	} else if msgpack.Unmarshal(env.Payload, &ack); !ack.Ack || ack.Accepted != 3 {
+		return fmt.Errorf("reply to an ack with %d accepted messages", ack.Accepted)
+	}
+
+	return nil
+}
+
+// Disconnect detiene las operaciones salientes pero no los heartbeats,
+// el servidor no corta la conexion
+func testDisconnectedHeartbeats(srv *server.Server, addr string) error {
+	tree := crdt.NewTree(0, addr)
+	defer tree.Close()
+
+	events, cancel := tree.Subscribe(10)
+	defer cancel()
+	tree.Disconnect()
+	time.Sleep(network.HeartbeatTimeout + network.HeartbeatInterval)
+	tree.Connect()
+	for {
+		select {
+		case e := <-events:
+			if e.Kind == crdt.EventConnection {
+				return fmt.Errorf("connection is %s", e.State)
+			}
+		default:
+			return nil
+		}
+	}
+}
+
+// una replica que descarta un paquete invalido pide el log de nuevo
+func testResync(srv *server.Server, addr string) error {
+	a, _ := dial(addr, network.Hello{Assign: true})
+	b, _ := dial(addr, network.Hello{Assign: true})
+	defer a.conn.Close()
+	defer b.conn.Close()
+
+	a.send("", 5, 0)
+	if n := b.receive(200 * time.Millisecond); n != 5 {
+		return fmt.Errorf("received %d messages", n)
+	}
+
+	b.conn.Write(network.SyncRequestMessage(""))
+	if n := b.receive(200 * time.Millisecond); n != 5 {
+		return fmt.Errorf("received %d messages of the log", n)
+	}
+
+	// el arbol sobrevive a un paquete que no es MessagePack valido
+	tree := crdt.NewTree(2, addr)
+	defer tree.Close()
+	tree.ApplyRemoteOperation([]byte{0xc1})
+	if err := tree.Add("after", "root"); err != nil {
+		return err
+	} else if n := b.receive(200 * time.Millisecond); n != 1 {
+		return fmt.Errorf("received %d operations after the invalid packet", n)
+	}
+
+	return nil
+}
+
+// las replicas sin FeatureCodecs no reciben los anuncios de codecs
+func testCodecs(srv *server.Server, addr string) error {
+	old, _ := dial(addr, network.Hello{Assign: true})
+	current, _ := dial(addr, network.Hello{Assign: true, Features: network.Features})
+	defer old.conn.Close()
+	defer current.conn.Close()
+
+	tree := crdt.NewTree(2, addr)
+	defer tree.Close()
+	tree.EnableCompactCodec()
+	got := []int{old.receive(200 * time.Millisecond), current.receive(200 * time.Millisecond)}
+	if !reflect.DeepEqual(got, []int{0, 1}) {
+		return fmt.Errorf("received %v capabilities messages", got)
+	}
+
+	return nil
+}
+
+// Replica que solo cuenta las operaciones que recibe
+type counter struct {
+	sync.Mutex
+	id       int
+	received int
+}
+
+func (c *counter) GetID() int {
+	return c.id
+}
+
+func (c *counter) ApplyRemoteOperation(data []byte) {
+	c.ApplyRemoteOperations([][]byte{data})
+}
+
+func (c *counter) ApplyRemoteOperations(packets [][]byte) {
+	c.Lock()
+	defer c.Unlock()
+	c.received += len(packets)
+}
+
+func (c *counter) count() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.received
+}
+
+// los lotes comprimidos llegan como operaciones sueltas, tambien el lote
+// que quedo pendiente al desconectar
+func testBatching(srv *server.Server, addr string) error {
+	senderTree, receiverTree := &counter{id: 0}, &counter{id: 1}
+	sender := network.NewCausalConn(senderTree, addr)
+	receiver := network.NewCausalConn(receiverTree, addr)
+	defer sender.Close()
+	defer receiver.Close()
+	sender.SetBatching(network.BatchConfig{
+		Enabled:  true,
+		MaxBytes: 1 << 20,
+		MaxDelay: 200 * time.Millisecond,
+		Compress: true,
+	})
+
+	op, err := msgpack.Marshal(map[string]any{"Data": make([]byte, 100)})
+	if err != nil {
+		return err
+	}
+
+	op = network.OperationMessage("", op)
+
+	for i := 0; i < 10; i++ {
+		sender.Send(op)
+	}
+
+	time.Sleep(time.Second)
+	if n := receiverTree.count(); n != 10 {
+		return fmt.Errorf("received %d operations of a batch", n)
+	}
+
+	sender.Send(op)
+	sender.Disconnect()
+	sender.Connect()
+	time.Sleep(time.Second)
+	if n := receiverTree.count(); n != 11 {
+		return fmt.Errorf("received %d operations after reconnecting", n)
+	}
+
+	return nil
+}
+
+// una replica de la version 1 recibe los mensajes sin sobre y los suyos
+// llegan a las demas en un sobre segun sus campos
+func testVersion1(srv *server.Server, addr string) error {
+	old, err := dial(addr, network.Hello{Assign: true, Version: 1})
+	if err != nil {
+		return err
+	}
+	defer old.conn.Close()
+
+	current, _ := dial(addr, network.Hello{Assign: true})
+	defer current.conn.Close()
+
+	old.send("", 1, 0)
+	current.conn.SetReadDeadline(time.Now().Add(time.Second))
+	data, err := current.dec.DecodeRaw()
+	if err != nil {
+		return err
+	} else if env, err := network.ReadEnvelope(data); err != nil || env.Type != network.TypeOperation {
+		return fmt.Errorf("version 1 message received as type %d: %v", env.Type, err)
+	}
+
+	current.send("", 1, 0)
+	old.conn.SetReadDeadline(time.Now().Add(time.Second))
+	data, err = old.dec.DecodeRaw()
+	if err != nil {
+		return err
+	} else if network.IsEnvelope(data) {
+		return fmt.Errorf("version 1 replica received an envelope")
+	}
+
+	// la suscripcion sin sobre tambien se entiende
+	subscribe, err := msgpack.Marshal(network.Header{Subscribe: "doc"})
+	if err != nil {
+		return err
+	}
+
+	old.conn.Write(subscribe)
+	time.Sleep(100 * time.Millisecond)
+	current.send("doc", 3, 0)
+	if n := old.receive(200 * time.Millisecond); n != 3 {
+		return fmt.Errorf("received %d messages of a document", n)
+	}
+
+	return nil
+}
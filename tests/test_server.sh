@@ -0,0 +1,14 @@
+#!/bin/sh
+echo "SERVER TEST"
+echo "Compiling test..."
+if ! go build ./test_server.go; then
+	echo "Compilation error"
+	exit 1
+fi
+
+if ! ./test_server.exe 2> /dev/null; then
+	echo "ERROR: Server test failed"
+	exit 1
+fi
+
+echo "OK: Test passed"